@@ -0,0 +1,3 @@
+module github.com/tuomur/polloeskadroona_updater
+
+go 1.21
@@ -2,305 +2,1313 @@ package main
 
 import (
 	"bufio"
-	"crypto/sha1"
-	"encoding/hex"
+	"context"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"os"
-	"path"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tuomur/polloeskadroona_updater/updater"
 )
 
 var repoURL = "https://koti.kapsi.fi/darkon/polloeskadroona/repo/updater.json"
 
-type repository struct {
-	DownloadRoot string
-	Files        [][]string
-}
+// base64 ed25519 public key that the manifest must be signed with, empty
+// accepts unsigned manifests. Pin a key into a build with
+// -ldflags "-X main.verifyKey=..."
+var verifyKey = ""
 
-type repositoryFile struct {
-	Name string
-	Hash string
-}
+// comma separated public key pins to require from the HTTPS servers, see
+// -pinSHA256. Built in the same way with -ldflags "-X main.pinSHA256=..."
+var pinSHA256 = ""
 
-func (f repositoryFile) HasValidPath() bool {
-	currentPath, _ := os.Getwd()
-	absolutePath, err := filepath.Abs(f.Name)
-	if err != nil {
-		fmt.Println("Unable to resolve path for", f.Name)
-		return false
-	}
-	cleaned := path.Clean(absolutePath)
-	return strings.Contains(cleaned, currentPath)
-}
+// credentials can be passed in the environment so they don't show up in
+// process listings
+const (
+	authEnv  = "UPDATER_AUTH"
+	tokenEnv = "UPDATER_TOKEN"
+)
 
-func (f repositoryFile) CheckHash(i *os.File) bool {
-	return calculateHash(i) == f.Hash
+// flags that can be set in the environment for scripted deployments. A flag
+// on the command line wins over them, and they win over the config file
+var flagEnvs = map[string]string{
+	"repoUrl":     "POLLO_REPO_URL",
+	"output":      "POLLO_OUTPUT",
+	"concurrency": "POLLO_CONCURRENCY",
 }
 
+// exit codes besides 0 for success and 1 for failures such as files that
+// didn't download, so that scripts can tell these apart. Listed in usage
+const (
+	// the repository couldn't be reached or its manifest is unusable,
+	// nothing was changed
+	exitManifest = 2
+	// the downloads stopped because the disk ran out of space
+	exitDiskFull = 3
+	// cancelled with ctrl+c or SIGTERM
+	exitInterrupted = 4
+	// another updater is running in the same directory
+	exitLocked = 5
+)
+
+const exitCodeUsage = `
+Exit codes:
+  0  success
+  1  some files failed, or -verify found files that don't match
+  2  the repository could not be reached or its manifest is invalid
+  3  the disk is full
+  4  interrupted
+  5  another updater is already running in this directory
+`
+
+// configFileName is read from the working directory when -config is not
+// given, see loadConfig
+const configFileName = "updater-config.json"
+
+// reposFileName lists the named repositories for -repo and -allRepos when
+// -repos is not given, see loadRepoList
+const reposFileName = "updater-repos.json"
+
+// shared so that prompts don't lose input buffered by each other
+var stdin = bufio.NewReader(os.Stdin)
+
 func main() {
-	var flagRepoURL = flag.String("repoUrl", "", "Set URL to custom repository json")
+	var flagRepoURL = flag.String("repoUrl", "", "Set URL or local path of a custom repository json, separate fallback URLs with commas. Also read from POLLO_REPO_URL")
 	var flagCreateRepo = flag.Bool("createRepo", false, "Create updater.json instead of updating files")
-	var flagOutputName = flag.String("output", "updater.json", "Name of the json file for -createRepo")
+	var flagUpdateRepo = flag.String("updateRepo", "", "Like -createRepo, but only hash the files that changed since this earlier json")
+	var flagOutputName = flag.String("output", "updater.json", "Name of the json file for -createRepo, its checksum is written next to it with a .sha256 suffix. Also read from POLLO_OUTPUT")
+	var flagDownloadRoot = flag.String("downloadRoot", updater.DefaultDownloadRoot, "For -createRepo, the URL the files are downloaded from. -updateRepo keeps the one of the earlier json unless this is set")
+	var flagHashAlgo = flag.String("hashAlgo", updater.DefaultHashAlgo, "Hash algorithm for -createRepo: sha1, sha256 or sha512")
+	var flagConcurrency = flag.Int("concurrency", 4, "Number of files to download or hash in parallel, also read from POLLO_CONCURRENCY")
+	var flagRetries = flag.Int("retries", 3, "Number of times to retry a failed download")
+	var flagDryRun = flag.Bool("dryRun", false, "Only show which files would be downloaded and removed")
+	var flagPrune = flag.Bool("prune", false, "Remove files that are not part of the repository from its directories")
+	var flagPruneExclude = flag.String("pruneExclude", "", "Never prune files or directories matching these comma separated glob patterns, e.g. userconfig. Added to the PruneExclude of the repository")
+	var flagPruneDryRun = flag.Bool("pruneDryRun", false, "Update normally but only list the files -prune would remove, implies -prune")
+	var flagYes = flag.Bool("yes", false, "Prune without asking for confirmation")
+	var flagPruneToTrash = flag.Bool("pruneToTrash", true, "Move pruned files under "+updater.TrashDirName+" instead of deleting them")
+	var flagPruneDelete = flag.Bool("pruneDelete", false, "Delete pruned files for good instead of moving them to the trash")
+	var flagPreserveTimes = flag.Bool("preserveTimes", true, "Set modification times of downloaded files to match the repository")
+	var flagForce = flag.Bool("force", false, "Download every file again even if it matches the repository, for a clean install")
+	var flagNoResume = flag.Bool("noResume", false, "Don't resume partial downloads, for servers without Range support")
+	var flagBundleThreshold = flag.Int("bundleThreshold", updater.DefaultBundleThreshold, "Download a bundle of the repository instead when at least this many of its files are needed, -1 never does")
+	var flagList = flag.Bool("list", false, "Only print the files, hashes and download roots of the repository, changes nothing. With -json prints the manifest")
+	var flagRepair = flag.Bool("repair", false, "Only download the missing and changed files, never prune anything even with -prune")
+	var flagChangedSince = flag.String("changedSince", "", "Only download the files that changed in the repository after this `time`, e.g. 2024-06-01 or 2024-06-01T18:00:00Z. Older files are left alone even if they differ, missing ones are still downloaded")
+	var flagVerifyAfter = flag.Bool("verifyAfter", false, "Hash every file again after the update to confirm the install is complete, exits with 1 if some still don't match")
+	var flagVerify = flag.Bool("verify", false, "Only check whether the files match the repository, exits with 1 if they don't")
+	var flagInclude = flag.String("include", "", "Only update files matching these comma separated glob patterns, e.g. missions/*.pbo")
+	var flagFile = flag.String("file", "", "Only check and download this one file of the repository, e.g. one a player reported broken. Never prunes. The name can also be given as the only argument")
+	var flagSkipOptional = flag.Bool("skipOptional", false, "Don't download the files the repository marks as optional, such as extra texture packs. The ones already installed are still updated")
+	var flagExclude = flag.String("exclude", "", "Leave files matching these comma separated glob patterns alone, wins over -include")
+	var flagOnlyChanged = flag.Bool("onlyChanged", false, "Don't list the files that were already up to date, and list the new, updated and removed files at the end")
+	var flagCompact = flag.Bool("compact", false, "Show the downloads on a single line that is updated in place, only failures get a line of their own. Needs a terminal")
+	var flagJSON = flag.Bool("json", false, "Print the results as JSON instead of the usual output")
+	var flagNoColor = flag.Bool("noColor", false, "Don't color the output, also turned off by setting NO_COLOR. Output that isn't a terminal never has colors")
+	var flagNoPause = flag.Bool("noPause", false, "Exit without waiting for Enter when done")
+	var flagNormalizeText = flag.String("normalizeText", "", "For -createRepo, comma separated glob patterns of text files whose hash ignores line endings and a BOM, e.g. *.cfg,*.txt")
+	var flagRelease = flag.String("release", "", "For -createRepo, the release of the new manifest, e.g. 42. Players of a release can later fetch just the changes from -deltaFrom")
+	var flagDeltaFrom = flag.String("deltaFrom", "", "For -createRepo, comma separated earlier manifests to write the changes since their release for, so their players only fetch and check those")
+	var flagBlockThreshold = flag.String("blockThreshold", "", "For -createRepo, also hash the blocks of files at least this large, e.g. 256MB, so a damaged copy is repaired by downloading only the blocks that differ")
+	var flagBlockSize = flag.String("blockSize", "4MB", "Size of the blocks hashed for -blockThreshold")
+	var flagPatchDir = flag.String("patchDir", "", "For -createRepo, directory of bsdiff patches named <hash>/<earlier hash>.bsdiff and served under the download root. A player whose copy matches an earlier hash only downloads the patch")
+	var flagGzipManifest = flag.Bool("gzipManifest", false, "For -createRepo, also write a gzipped copy of the json and its deltas with a .gz suffix, for servers that send it to clients accepting gzip such as nginx with gzip_static")
+	var flagSignKey = flag.String("signKey", "", "PEM ed25519 private key to sign the -createRepo output with, the signature is written next to it with a .sig suffix")
+	var flagHeadCheck = flag.Bool("headCheck", false, "Check that the server has the files and get their sizes with HEAD requests before downloading, for servers that support it")
+	var flagSaveManifest = flag.String("saveManifest", "", "Save the fetched manifest to this file once it has been checked, e.g. to run the updater against the copy later with -repoUrl")
+	var flagVerifyKey = flag.String("verifyKey", "", "Base64 ed25519 public key, only use the repository if its signature matches")
+	var flagLogLevel = flag.String("logLevel", "info", "How much to print: error, warn, info or debug. Below info only problems are printed")
+	var flagLogFile = flag.String("logFile", "", "Also write the output and log to this file, e.g. to attach to a bug report")
+	var flagStatsFile = flag.String("statsFile", "", "Append a JSON line with the counts, bytes and duration of the run to this file, for collecting the results of many machines")
+	var flagHeaders headerList
+	flag.Var(&flagHeaders, "header", "Extra `\"Key: Value\"` HTTP header to send with every request, can be repeated")
+	var flagAuth = flag.String("auth", "", "`user:password` for a repository behind HTTP basic auth, also read from "+authEnv)
+	var flagToken = flag.String("token", "", "Bearer token for a private repository, also read from "+tokenEnv)
+	var flagMaxRate = flag.String("maxRate", "", "Limit the total download rate per second, e.g. 2MB or 500KB")
+	var flagMaxFileSize = flag.String("maxFileSize", "", "Don't download files larger than this, e.g. 500MB, and count them as failed")
+	var flagMaxManifestSize = flag.String("maxManifestSize", "", "Refuse repository manifests larger than this, e.g. 64MB. Defaults to "+updater.FormatBytes(updater.DefaultMaxManifestSize))
+	var flagNoRedirect = flag.Bool("noRedirect", false, "Fail instead of following HTTP redirects")
+	var flagProxy = flag.String("proxy", "", "Connect through this proxy, e.g. http://host:8080 or socks5://host:1080. By default HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used")
+	var flagPinSHA256 = flag.String("pinSHA256", "", "Only accept HTTPS servers whose certificate public key has one of these comma separated SHA-256 `pins`, in hex or as sha256/base64")
+	var flagForceIPv4 = flag.Bool("forceIPv4", false, "Only connect over IPv4, for networks where IPv6 to the server is slow or broken. Only affects the updater")
+	var flagDNSServer = flag.String("dnsServer", "", "Look up host names from this DNS `server` instead of the system's, e.g. 1.1.1.1. Only affects the updater")
+	var flagBackup = flag.Bool("backup", false, "Save the files about to be replaced so that -rollback can restore them")
+	var flagRollback = flag.String("rollback", "", "Restore the files saved by -backup at the given `time`, e.g. 20240101-120000")
+	var flagRun = flag.String("run", "", "Command to start after a successful update instead of waiting for Enter, e.g. the game. Defaults to the Run command of the repository, -run= turns it off")
+	var flagPostDownload = flag.Bool("postDownload", false, "Run the commands the repository has for downloaded files of some types, e.g. to extract archives. Only use with repositories you trust")
+	var flagMaxErrors = flag.Int("maxErrors", 0, "Stop downloading once this many files have failed, e.g. when the server is down. 0 tries every file")
+	var flagPreRun = flag.String("preRun", "", "Command to run before checking the files, e.g. to close the game. The update is aborted if it fails")
+	var flagTimeout = flag.Duration("timeout", updater.DefaultTimeout, "Give up on a request when the server doesn't respond for this long")
+	var flagDir = flag.String("dir", "", "Install into this directory instead of the current one. Other paths on the command line stay relative to where the updater was started, "+configFileName+" is looked for in it")
+	var flagRepos = flag.String("repos", reposFileName, "JSON list of named repositories for -repo and -allRepos, such as [{\"Name\": \"main\", \"RepoURL\": \"...\", \"Dir\": \"@main\"}]. Relative paths in it are relative to the list")
+	var flagRepo = flag.String("repo", "", "Update the repository of this `name` from -repos into its own directory, instead of -repoUrl and -dir")
+	var flagAllRepos = flag.Bool("allRepos", false, "Update every repository of -repos in turn, each with the other flags given")
+	var flagConfig = flag.String("config", "", "JSON file of flag defaults such as {\"repoUrl\": \"...\", \"concurrency\": 8}, "+configFileName+" if it exists. Flags on the command line win over it")
 
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), exitCodeUsage)
+	}
 	flag.Parse()
 	directoryNames := flag.Args()
 
+	if *flagAllRepos {
+		repos, reposError := loadRepoList(*flagRepos)
+		if reposError != nil {
+			fmt.Println("Invalid -repos:", reposError)
+			os.Exit(1)
+		}
+		exitCode := updateAllRepos(repos, *flagJSON)
+		if !*flagNoPause && !*flagJSON {
+			pause()
+		}
+		os.Exit(exitCode)
+	}
+	if len(*flagRepo) > 0 {
+		if repoError := selectRepo(*flagRepos, *flagRepo); repoError != nil {
+			fmt.Println("Invalid -repo:", repoError)
+			os.Exit(1)
+		}
+	}
+	// after -repo, which only allows the -repoUrl and -dir of the list. Each
+	// run of -allRepos reads the environment itself
+	if envError := loadFlagEnvs(); envError != nil {
+		fmt.Println(envError)
+		os.Exit(1)
+	}
+	if len(*flagDir) > 0 {
+		if dirError := changeDir(*flagDir); dirError != nil {
+			fmt.Println("Invalid -dir:", dirError)
+			os.Exit(1)
+		}
+	}
+	configName, configRequired := *flagConfig, true
+	if len(configName) == 0 {
+		configName, configRequired = configFileName, false
+	}
+	if configError := loadConfig(configName, configRequired); configError != nil {
+		fmt.Println("Invalid config file:", configError)
+		os.Exit(1)
+	}
+
 	if len(*flagRepoURL) > 0 {
 		repoURL = *flagRepoURL
 	}
+	if len(*flagVerifyKey) > 0 {
+		verifyKey = *flagVerifyKey
+	}
+	if len(*flagPinSHA256) > 0 {
+		pinSHA256 = *flagPinSHA256
+	}
+	if *flagRetries < 0 {
+		fmt.Println("-retries can't be negative")
+		os.Exit(1)
+	}
+	if *flagTimeout <= 0 {
+		fmt.Println("-timeout must be positive")
+		os.Exit(1)
+	}
+	var maxRate int64
+	if len(*flagMaxRate) > 0 {
+		var rateError error
+		if maxRate, rateError = updater.ParseBytes(*flagMaxRate); rateError != nil || maxRate <= 0 {
+			fmt.Println("Invalid -maxRate:", *flagMaxRate)
+			os.Exit(1)
+		}
+	}
+	var maxFileSize int64
+	if len(*flagMaxFileSize) > 0 {
+		var sizeError error
+		if maxFileSize, sizeError = updater.ParseBytes(*flagMaxFileSize); sizeError != nil || maxFileSize <= 0 {
+			fmt.Println("Invalid -maxFileSize:", *flagMaxFileSize)
+			os.Exit(1)
+		}
+	}
+	var maxManifestSize int64
+	if len(*flagMaxManifestSize) > 0 {
+		var sizeError error
+		if maxManifestSize, sizeError = updater.ParseBytes(*flagMaxManifestSize); sizeError != nil || maxManifestSize <= 0 {
+			fmt.Println("Invalid -maxManifestSize:", *flagMaxManifestSize)
+			os.Exit(1)
+		}
+	}
+	if len(*flagProxy) > 0 {
+		if _, proxyError := updater.ParseProxy(*flagProxy); proxyError != nil {
+			fmt.Println("Invalid -proxy:", proxyError)
+			os.Exit(1)
+		}
+	}
+	if *flagMaxErrors < 0 {
+		fmt.Println("-maxErrors can't be negative")
+		os.Exit(1)
+	}
+	if *flagConcurrency < 1 {
+		fmt.Println("-concurrency must be at least 1")
+		os.Exit(1)
+	}
+	// the arguments are the directories to add with -createRepo, otherwise
+	// the one file to check
+	fileName := *flagFile
+	if len(directoryNames) > 0 && !*flagCreateRepo && len(*flagUpdateRepo) == 0 {
+		if len(directoryNames) > 1 || len(fileName) > 0 {
+			fmt.Println("Only one file can be checked at a time, with -file or as the only argument")
+			os.Exit(1)
+		}
+		fileName = directoryNames[0]
+	}
+	if *flagRepair && *flagVerify {
+		fmt.Println("-repair and -verify can't be used together")
+		os.Exit(1)
+	}
 
-	if *flagCreateRepo {
-		createRepo(directoryNames, *flagOutputName)
+	if *flagCreateRepo || len(*flagUpdateRepo) > 0 {
+		createOptions := updater.CreateOptions{
+			HashAlgo:    *flagHashAlgo,
+			Concurrency: *flagConcurrency,
+			Output:      os.Stdout,
+		}
+		if len(*flagBlockThreshold) > 0 {
+			var sizeError error
+			if createOptions.BlockThreshold, sizeError = updater.ParseBytes(*flagBlockThreshold); sizeError != nil || createOptions.BlockThreshold <= 0 {
+				fmt.Println("Invalid -blockThreshold:", *flagBlockThreshold)
+				os.Exit(1)
+			}
+			if createOptions.BlockSize, sizeError = updater.ParseBytes(*flagBlockSize); sizeError != nil || createOptions.BlockSize <= 0 {
+				fmt.Println("Invalid -blockSize:", *flagBlockSize)
+				os.Exit(1)
+			}
+		}
+		if flagWasSet("normalizeText") {
+			createOptions.TextFiles = splitPatterns(*flagNormalizeText)
+		}
+		createOptions.Release = *flagRelease
+		if flagWasSet("downloadRoot") {
+			createOptions.DownloadRoot = *flagDownloadRoot
+		}
+		if len(*flagPatchDir) > 0 {
+			if filepath.IsAbs(*flagPatchDir) || strings.Contains(*flagPatchDir, "://") {
+				fmt.Println("-patchDir has to be a relative directory, its patches are downloaded from the same place under the download root")
+				os.Exit(1)
+			}
+			createOptions.PatchDir = *flagPatchDir
+		}
+		if len(*flagUpdateRepo) > 0 {
+			previous, err := updater.LoadRepository(*flagUpdateRepo)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			createOptions.Previous = previous
+			// keep the algorithm of the earlier manifest unless asked not to
+			if !flagWasSet("hashAlgo") {
+				createOptions.HashAlgo = ""
+			}
+			createOptions.Exclude = append(createOptions.Exclude, *flagUpdateRepo)
+		}
+		if createError := createRepo(directoryNames, *flagOutputName, *flagSignKey, splitPatterns(*flagDeltaFrom), *flagGzipManifest, createOptions); createError != nil {
+			fmt.Println(createError)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(*flagRollback) > 0 {
+		restored, err := rollback(*flagRollback)
+		exitCode := 0
+		fmt.Println("")
+		if err != nil {
+			fmt.Println(err)
+			exitCode = 1
+		} else {
+			fmt.Printf("Restored %d files\n", len(restored))
+		}
+		if !*flagNoPause {
+			pause()
+		}
+		os.Exit(exitCode)
+	}
+
+	var publicKey ed25519.PublicKey
+	if len(verifyKey) > 0 {
+		var keyError error
+		publicKey, keyError = updater.ParsePublicKey(verifyKey)
+		if keyError != nil {
+			fmt.Println("Invalid -verifyKey:", keyError)
+			os.Exit(1)
+		}
+	}
+
+	var changedSince time.Time
+	if len(*flagChangedSince) > 0 {
+		var timeError error
+		if changedSince, timeError = parseTime(*flagChangedSince); timeError != nil {
+			fmt.Println("Invalid -changedSince:", timeError)
+			os.Exit(1)
+		}
+	}
+
+	var pins [][]byte
+	for _, pin := range splitPatterns(pinSHA256) {
+		hash, pinError := updater.ParsePin(pin)
+		if pinError != nil {
+			fmt.Println("Invalid -pinSHA256:", pinError)
+			os.Exit(1)
+		}
+		pins = append(pins, hash)
+	}
+
+	options := updater.UpdateOptions{
+		RepoURL:         repoURL,
+		Concurrency:     *flagConcurrency,
+		Retries:         *flagRetries,
+		DryRun:          *flagDryRun,
+		Prune:           (*flagPrune || *flagPruneDryRun) && !*flagRepair,
+		PruneDryRun:     *flagPruneDryRun,
+		PruneToTrash:    *flagPruneToTrash && !*flagPruneDelete,
+		PreserveTimes:   *flagPreserveTimes,
+		NoResume:        *flagNoResume,
+		Force:           *flagForce,
+		BundleThreshold: *flagBundleThreshold,
+		Verify:          *flagVerify,
+		VerifyAfter:     *flagVerifyAfter,
+		ChangedSince:    changedSince,
+		SaveManifest:    *flagSaveManifest,
+		HeadCheck:       *flagHeadCheck,
+		MaxErrors:       *flagMaxErrors,
+		Backup:          *flagBackup,
+		HideUnchanged:   *flagOnlyChanged,
+		// the config file is not a part of the repository
+		PruneExclude:    append(splitPatterns(*flagPruneExclude), configFileName),
+		Include:         splitPatterns(*flagInclude),
+		File:            fileName,
+		SkipOptional:    *flagSkipOptional,
+		Exclude:         splitPatterns(*flagExclude),
+		VerifyKey:       publicKey,
+		Header:          flagHeaders.header,
+		BasicAuth:       flagOrEnv(*flagAuth, authEnv),
+		Token:           flagOrEnv(*flagToken, tokenEnv),
+		MaxRate:         maxRate,
+		MaxFileSize:     maxFileSize,
+		MaxManifestSize: maxManifestSize,
+		NoRedirect:      *flagNoRedirect,
+		Proxy:           *flagProxy,
+		ForceIPv4:       *flagForceIPv4,
+		PinSHA256:       pins,
+		Timeout:         *flagTimeout,
+		Output:          os.Stdout,
+		Terminal:        isTerminal(os.Stdout),
+		Compact:         *flagCompact,
+		Color:           isTerminal(os.Stdout) && !*flagNoColor && len(os.Getenv("NO_COLOR")) == 0 && updater.EnableColor(os.Stdout),
+	}
+	if len(*flagDNSServer) > 0 {
+		options.DNSServer = updater.DNSServerAddress(*flagDNSServer)
+	}
+	if !*flagYes {
+		options.ConfirmPrune = confirmPrune
+	}
+	if *flagPostDownload {
+		options.PostDownload = runCommand
+	}
+	if len(*flagPreRun) > 0 {
+		options.PreRun = func() error {
+			return runCommand(*flagPreRun)
+		}
+	}
+	if *flagJSON {
+		// stdout only gets the report
+		options.Output = ioutil.Discard
+	}
+
+	var logLevel slog.Level
+	if levelError := logLevel.UnmarshalText([]byte(*flagLogLevel)); levelError != nil {
+		fmt.Println("Invalid -logLevel:", levelError)
+		os.Exit(1)
+	}
+	closeLog, logError := setupLogging(&options, logLevel, *flagLogFile)
+	if logError != nil {
+		fmt.Println(logError)
+		os.Exit(1)
+	}
+
+	// ctrl+c and SIGTERM cancel the update instead of killing it outright so
+	// that temp files get cleaned up and the hash cache saved. Once that
+	// has started, a second ctrl+c kills the updater as usual
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if *flagList {
+		exitCode := listRepository(ctx, options, *flagJSON)
+		stop()
+		if !*flagNoPause && !*flagJSON {
+			pause()
+		}
+		closeLog()
+		os.Exit(exitCode)
+	}
+	if *flagRepair && !*flagJSON {
+		fmt.Println("Repair mode: missing and changed files are downloaded again, nothing is deleted")
+	}
+	report, err := updater.Update(ctx, options)
+	stop()
+
+	exitCode := 0
+	if *flagJSON {
+		reportBytes, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(reportBytes))
+		exitCode = exitCodeFor(report, err, options)
 	} else {
-		updateFiles()
+		if *flagOnlyChanged && err == nil && !options.Verify {
+			printChanges(report, options.DryRun)
+		}
+		exitCode = printSummary(report, err, options)
+	}
+	if len(*flagStatsFile) > 0 {
+		if statsError := appendStats(*flagStatsFile, report, err, exitCode); statsError != nil {
+			fmt.Println("Writing -statsFile failed:", statsError)
+		}
 	}
+	command := *flagRun
+	if !flagWasSet("run") {
+		command = report.Run
+	}
+	switch {
+	case len(command) == 0 || options.DryRun || options.Verify || *flagJSON:
+		if !*flagNoPause && !*flagJSON {
+			pause()
+		}
+	case exitCode != 0:
+		fmt.Println("Not running", command, "because the update did not succeed")
+		if !*flagNoPause {
+			pause()
+		}
+	default:
+		if runError := runCommand(command); runError != nil {
+			fmt.Println("Running", command, "failed:", runError)
+			exitCode = 1
+			if !*flagNoPause {
+				pause()
+			}
+		}
+	}
+	closeLog()
+	os.Exit(exitCode)
 }
 
-func createRepo(directoryNames []string, outputName string) {
-	newRepo := repository{}
-	newRepo.DownloadRoot = "https://koti.kapsi.fi/darkon/polloeskadroona/repo/"
-	for _, directoryName := range directoryNames {
-		if _, statError := os.Stat(directoryName); os.IsNotExist(statError) {
-			fmt.Println(statError)
-			continue
+// listRepository prints what the repository offers without touching any
+// local file, as support needs to see when troubleshooting
+func listRepository(ctx context.Context, options updater.UpdateOptions, asJSON bool) int {
+	// keeps even the manifest cache as it is
+	options.DryRun = true
+	fmt.Fprintln(options.Output, "Repository:", options.RepoURL)
+	repo, err := updater.FetchRepository(ctx, options)
+	if err != nil {
+		if asJSON {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			fmt.Println(err)
 		}
-		filepath.Walk(directoryName, func(currentPath string, info os.FileInfo, err error) error {
-			if info.IsDir() {
-				return nil
-			}
+		return exitCodeFor(&updater.Report{Interrupted: ctx.Err() != nil}, err, options)
+	}
+	if asJSON {
+		repoBytes, _ := json.MarshalIndent(repo, "", "  ")
+		fmt.Println(string(repoBytes))
+		return 0
+	}
 
-			currentFile, openError := os.Open(currentPath)
-			if openError != nil {
-				return openError
-			}
-			defer currentFile.Close()
+	fmt.Println("")
+	fmt.Println("DownloadRoot:", repo.DownloadRoot)
+	for _, mirror := range repo.Mirrors {
+		fmt.Println("Mirror:", mirror)
+	}
+	fmt.Println("HashAlgo:", repo.HashAlgo)
+	fmt.Println("")
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "NAME\tHASH\tSIZE")
+	var totalSize int64
+	for _, rf := range repo.Files {
+		hash, size := rf.Hash, ""
+		if len(rf.Link) > 0 {
+			hash = "-> " + rf.Link
+		}
+		if rf.Size > 0 {
+			size = updater.FormatBytes(rf.Size)
+			totalSize += rf.Size
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\n", rf.Name, hash, size)
+	}
+	table.Flush()
+	fmt.Printf("\n%d files, %s\n", len(repo.Files), updater.FormatBytes(totalSize))
+	return 0
+}
 
-			hash := calculateHash(currentFile)
-			currentPathSlash := filepath.ToSlash(currentPath)
-			fmt.Println(currentPathSlash, ":", hash)
-			newRepo.Files = append(newRepo.Files, []string{currentPathSlash, hash})
-			return nil
-		})
+// rollback holds the same lock as updates so a rollback can't mix with an
+// update running at the same time
+func rollback(set string) ([]string, error) {
+	unlock, err := updater.Lock(updater.LockFileName)
+	if err != nil {
+		return nil, err
 	}
+	defer unlock()
+	return updater.Rollback(set, os.Stdout)
+}
 
-	repoBytes, marshalError := json.Marshal(newRepo)
-	if marshalError != nil {
-		fmt.Println(marshalError)
-		return
+// runCommand starts command in the console of the updater and waits for it
+// to exit
+func runCommand(command string) error {
+	args := splitCommand(command)
+	if len(args) == 0 {
+		return errors.New("empty command")
 	}
-	ioutil.WriteFile(outputName, repoBytes, 0644)
-	fmt.Println("\nWriting output to", outputName)
+	fmt.Println("")
+	fmt.Println("Running", command)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
 }
 
-// go doesn't have "str in []string" check built in
-func stringInSlice(a string, list []string) bool {
-	for _, b := range list {
-		if b == a {
-			return true
+// splitCommand splits a command line at spaces, keeping double quoted parts
+// together. Backslashes are left alone so windows paths work as they are.
+func splitCommand(command string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes, inArg := false, false
+	for _, r := range command {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inArg = true
+		case (r == ' ' || r == '\t') && !inQuotes:
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
 		}
 	}
-	return false
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args
 }
 
-func updateFiles() {
-	fmt.Println("Repository:", repoURL)
+func createRepo(directoryNames []string, outputName string, signKeyName string, deltaFrom []string, gzipManifest bool, options updater.CreateOptions) error {
+	// read the key first so a bad key doesn't waste a whole hashing run
+	var signKey ed25519.PrivateKey
+	if len(signKeyName) > 0 {
+		keyBytes, readError := ioutil.ReadFile(signKeyName)
+		if readError != nil {
+			return readError
+		}
+		var keyError error
+		signKey, keyError = updater.ParsePrivateKey(keyBytes)
+		if keyError != nil {
+			return fmt.Errorf("invalid -signKey: %v", keyError)
+		}
+	}
 
-	downloadRoot, listOfRepositoryFiles := getRepositoryContent()
-	if listOfRepositoryFiles == nil {
-		return
+	ignoreRules, ignoreError := updater.LoadIgnoreFile(updater.IgnoreFileName)
+	if ignoreError != nil {
+		return ignoreError
 	}
+	options.Ignore = ignoreRules
+	// the output may be inside a directory that is being added
+	options.Exclude = append(options.Exclude, outputName, outputName+updater.SignatureSuffix, outputName+updater.ChecksumSuffix, outputName+".gz", configFileName)
 
-	var downloadFiles []repositoryFile
-	downloadErrors := 0
+	// the earlier manifests are checked before hashing too
+	var previousRepos []*updater.Repository
+	for _, previousName := range deltaFrom {
+		previous, err := updater.LoadRepository(previousName)
+		if err != nil {
+			return err
+		}
+		if len(previous.Release) == 0 || len(options.Release) == 0 || previous.Release == options.Release {
+			return fmt.Errorf("-deltaFrom needs a -release and earlier manifests of a different release, %s is release %s", previousName, previous.Release)
+		}
+		previousRepos = append(previousRepos, previous)
+	}
 
-	var directoriesToPrune []string
+	newRepo, err := updater.CreateRepository(directoryNames, options)
+	if err != nil {
+		return err
+	}
+	// a release is worth a delta directory even before the first delta
+	if len(options.Release) > 0 && len(newRepo.Deltas) == 0 {
+		newRepo.Deltas = "deltas/"
+	}
+	if len(previousRepos) > 0 && strings.Contains(newRepo.Deltas, "://") {
+		return fmt.Errorf("can't write the deltas to %s, Deltas has to be a directory next to %s", newRepo.Deltas, outputName)
+	}
+	fmt.Println("\nWriting output to", outputName)
+	if err := newRepo.SaveSigned(outputName, signKey); err != nil {
+		return err
+	}
+	if gzipManifest {
+		if err := updater.SaveGzipped(outputName); err != nil {
+			return err
+		}
+	}
+	for _, previous := range previousRepos {
+		delta, deltaError := updater.NewDelta(previous, newRepo)
+		if deltaError != nil {
+			return deltaError
+		}
+		deltaName := filepath.Join(filepath.Dir(outputName), filepath.FromSlash(newRepo.Deltas), previous.Release+".json")
+		fmt.Printf("Writing the %d changes since release %s to %s\n", len(delta.Files)+len(delta.Removed), previous.Release, deltaName)
+		if err := os.MkdirAll(filepath.Dir(deltaName), 0755); err != nil {
+			return err
+		}
+		if err := delta.SaveSigned(deltaName, signKey); err != nil {
+			return err
+		}
+		if gzipManifest {
+			if err := updater.SaveGzipped(deltaName); err != nil {
+				return err
+			}
+		}
+	}
+	if signKey != nil {
+		fmt.Println("Signed with public key", updater.EncodePublicKey(signKey.Public().(ed25519.PublicKey)))
+	}
+	return nil
+}
 
-	fmt.Println("")
+// runStats is the line -statsFile gets for every run
+type runStats struct {
+	Hostname        string
+	Time            time.Time
+	Repository      string
+	ManifestVersion int
+	Downloaded      int
+	Unchanged       int
+	Pruned          int
+	Failed          int
+	DownloadedBytes int64
+	DurationSeconds float64
+	ExitCode        int
+	Error           string `json:",omitempty"`
+}
+
+// appendStats adds the outcome of the run to name as a line of JSON, so many
+// runs and machines can be fed to a log pipeline
+func appendStats(name string, report *updater.Report, err error, exitCode int) error {
+	hostname, _ := os.Hostname()
+	stats := runStats{
+		Hostname:        hostname,
+		Time:            time.Now().UTC(),
+		Repository:      repoURL,
+		ManifestVersion: report.ManifestVersion,
+		Downloaded:      len(report.Downloaded),
+		Unchanged:       len(report.Unchanged),
+		Pruned:          len(report.Pruned),
+		Failed:          len(report.Failed),
+		DownloadedBytes: report.DownloadedBytes,
+		DurationSeconds: report.Elapsed.Seconds(),
+		ExitCode:        exitCode,
+	}
+	if err != nil {
+		stats.Error = err.Error()
+	}
+	statsBytes, marshalError := json.Marshal(stats)
+	if marshalError != nil {
+		return marshalError
+	}
+	statsFile, openError := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if openError != nil {
+		return openError
+	}
+	if _, writeError := statsFile.Write(append(statsBytes, '\n')); writeError != nil {
+		statsFile.Close()
+		return writeError
+	}
+	return statsFile.Close()
+}
 
-	// check existing files and their checksum
-	for _, rf := range listOfRepositoryFiles {
+// setupLogging points options.Logger at the console and logFileName. At
+// info level the usual output already tells the user everything, so log
+// records only reach the console when debugging or when the usual output
+// is turned off for warn and error. The log file gets both.
+func setupLogging(options *updater.UpdateOptions, level slog.Level, logFileName string) (func(), error) {
+	handlerOptions := &slog.HandlerOptions{Level: level}
+	var handlers []slog.Handler
+	closeLog := func() {}
 
-		if !rf.HasValidPath() {
-			// invalid path, ignore
-			continue
+	consoleOutput := options.Output
+	if level > slog.LevelInfo {
+		consoleOutput = ioutil.Discard
+	}
+	if level != slog.LevelInfo {
+		handlers = append(handlers, slog.NewTextHandler(os.Stderr, handlerOptions))
+	}
+	options.Output = consoleOutput
+
+	if len(logFileName) > 0 {
+		logFile, err := os.OpenFile(logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return closeLog, err
 		}
+		closeLog = func() { logFile.Close() }
+		// colors are for the terminal only
+		options.Output = io.MultiWriter(consoleOutput, updater.StripColors(logFile))
+		handlers = append(handlers, slog.NewTextHandler(logFile, handlerOptions))
+	}
+	options.Logger = slog.New(multiHandler(handlers))
+	return closeLog, nil
+}
 
-		fmt.Print(rf.Name + " : ")
-		var rfStatus string
+// multiHandler passes every record on to all of its handlers
+type multiHandler []slog.Handler
 
-		// collect directory name to list of directories for pruning
-		pathParts := strings.Split(rf.Name, "/")
-		if !stringInSlice(pathParts[0], directoriesToPrune) {
-			directoriesToPrune = append(directoriesToPrune, pathParts[0])
+func (m multiHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range m {
+		if h.Enabled(ctx, level) {
+			return true
 		}
+	}
+	return false
+}
 
-		existingFile, openError := os.Open(rf.Name)
-
-		if os.IsNotExist(openError) {
-			downloadFiles = append(downloadFiles, rf)
-			fmt.Println("Download")
-			continue
-		} else if openError != nil {
-			fmt.Println("Skip:", openError)
+func (m multiHandler) Handle(ctx context.Context, record slog.Record) error {
+	var firstError error
+	for _, h := range m {
+		if !h.Enabled(ctx, record.Level) {
 			continue
 		}
-
-		if rf.CheckHash(existingFile) {
-			rfStatus = "OK"
-		} else {
-			rfStatus = "Download (Changed)"
-			downloadFiles = append(downloadFiles, rf)
+		if err := h.Handle(ctx, record.Clone()); err != nil && firstError == nil {
+			firstError = err
 		}
-		existingFile.Close()
-		fmt.Println(rfStatus)
 	}
+	return firstError
+}
 
-	// remove any file that is not part of the repository. directories will
-	// not be removed
-	fmt.Println("")
-	fmt.Println("Pruning non-repository files")
-	for _, pruneDir := range directoriesToPrune {
-		if _, err := os.Stat(pruneDir); os.IsNotExist(err) {
+func (m multiHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithAttrs(attrs)
+	}
+	return handlers
+}
+
+func (m multiHandler) WithGroup(name string) slog.Handler {
+	handlers := make(multiHandler, len(m))
+	for i, h := range m {
+		handlers[i] = h.WithGroup(name)
+	}
+	return handlers
+}
+
+// headerList collects the repeated -header flags
+type headerList struct {
+	header http.Header
+}
+
+func (h *headerList) String() string {
+	return ""
+}
+
+func (h *headerList) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 {
+		return errors.New("header must be in \"Key: Value\" form")
+	}
+	if h.header == nil {
+		h.header = http.Header{}
+	}
+	h.header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// loadConfig sets the flags that were not given on the command line or in
+// the environment from a JSON object of flag names and values, so both win
+// over the config file and the config file wins over the built-in default.
+// A repeatable flag such as header takes a list. A missing file is only an
+// error if required.
+func loadConfig(name string, required bool) error {
+	configBytes, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) && !required {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(configBytes)))
+	// numbers are passed to the flags as they are written
+	decoder.UseNumber()
+	var values map[string]interface{}
+	if err := decoder.Decode(&values); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for key, value := range values {
+		if key == "dir" {
+			return fmt.Errorf("%s: dir can't be set in the config file, -dir is where the config file is read from", name)
+		}
+		if flag.Lookup(key) == nil || key == "config" {
+			return fmt.Errorf("%s: unknown setting %q, the settings are named like the flags", name, key)
+		}
+		if explicit[key] {
 			continue
 		}
-		filepath.Walk(pruneDir, func(currentPath string, info os.FileInfo, err error) error {
-			if info.IsDir() {
-				return nil
-			}
-			currentPathSlash := filepath.ToSlash(currentPath)
-			belongsToRepo := false
-			for _, rf := range listOfRepositoryFiles {
-				if currentPathSlash == rf.Name {
-					belongsToRepo = true
-				}
+		items, isList := value.([]interface{})
+		if !isList {
+			items = []interface{}{value}
+		}
+		for _, item := range items {
+			if err := flag.Set(key, fmt.Sprint(item)); err != nil {
+				return fmt.Errorf("%s: invalid %s: %v", name, key, err)
 			}
-			if !belongsToRepo {
-				fmt.Println("Removing", currentPathSlash)
-				if removeError := os.RemoveAll(currentPathSlash); removeError != nil {
-					return removeError
+		}
+	}
+	return nil
+}
+
+// pathFlags hold paths, or comma separated lists of them, that are taken
+// relative to where the updater was started even with -dir
+var pathFlags = []string{"config", "logFile", "statsFile", "output", "updateRepo", "signKey", "deltaFrom", "repoUrl", "saveManifest"}
+
+// changeDir makes dir the working directory, which every file of the
+// repository is relative to, creating it if needed. The paths set so far
+// are made absolute first
+func changeDir(dir string) error {
+	for _, name := range pathFlags {
+		if !flagWasSet(name) {
+			continue
+		}
+		pathFlag := flag.Lookup(name)
+		var resolved []string
+		for _, item := range strings.Split(pathFlag.Value.String(), ",") {
+			if trimmed := strings.TrimSpace(item); len(trimmed) > 0 && !strings.Contains(trimmed, "://") && !filepath.IsAbs(trimmed) {
+				if absolutePath, err := filepath.Abs(trimmed); err == nil {
+					item = absolutePath
 				}
 			}
-			return nil
-		})
+			resolved = append(resolved, item)
+		}
+		if err := pathFlag.Value.Set(strings.Join(resolved, ",")); err != nil {
+			return err
+		}
+	}
+	// a first install can go to a directory that doesn't exist yet
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
 	}
+	return os.Chdir(dir)
+}
 
-	// download files that are missing or failed checksum in the first loop
-	fmt.Println("")
-	for _, rf := range downloadFiles {
+// namedRepo is an entry of the -repos list
+type namedRepo struct {
+	Name    string
+	RepoURL string
+	// where the repository is installed, see -dir
+	Dir string
+}
 
-		fmt.Print("Downloading ", rf.Name, " ... ")
+// loadRepoList reads the -repos list. Relative local paths in it are made
+// relative to the list rather than to where the updater was started.
+func loadRepoList(name string) ([]namedRepo, error) {
+	listBytes, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var repos []namedRepo
+	if err := json.Unmarshal(listBytes, &repos); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if len(repos) == 0 {
+		return nil, fmt.Errorf("%s lists no repositories", name)
+	}
+	base := filepath.Dir(name)
+	seen := map[string]bool{}
+	for i, repo := range repos {
+		if len(repo.Name) == 0 || len(repo.RepoURL) == 0 || len(repo.Dir) == 0 {
+			return nil, fmt.Errorf("%s: entry %d needs a Name, RepoURL and Dir", name, i)
+		}
+		if seen[repo.Name] {
+			return nil, fmt.Errorf("%s: %s is listed more than once", name, repo.Name)
+		}
+		seen[repo.Name] = true
+		if !filepath.IsAbs(repo.Dir) {
+			repos[i].Dir = filepath.Join(base, repo.Dir)
+		}
+		var addresses []string
+		for _, address := range strings.Split(repo.RepoURL, ",") {
+			address = strings.TrimSpace(address)
+			if !strings.Contains(address, "://") && !filepath.IsAbs(address) {
+				address = filepath.Join(base, address)
+			}
+			addresses = append(addresses, address)
+		}
+		repos[i].RepoURL = strings.Join(addresses, ",")
+	}
+	return repos, nil
+}
 
-		makeDirError := os.MkdirAll(filepath.Dir(rf.Name), os.ModeDir)
-		if makeDirError != nil {
-			fmt.Println("Unable to create directory for ", rf.Name, " : ", makeDirError)
-			downloadErrors++
+// selectRepo sets -repoUrl and -dir from the entry of the -repos list
+// called name
+func selectRepo(listName string, name string) error {
+	if flagWasSet("repoUrl") || flagWasSet("dir") {
+		return errors.New("-repo can't be used with -repoUrl or -dir, they come from the list")
+	}
+	repos, err := loadRepoList(listName)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		if repo.Name != name {
 			continue
 		}
+		if err := flag.Set("repoUrl", repo.RepoURL); err != nil {
+			return err
+		}
+		return flag.Set("dir", repo.Dir)
+	}
+	var names []string
+	for _, repo := range repos {
+		names = append(names, repo.Name)
+	}
+	return fmt.Errorf("%s is not in %s, the repositories are %s", name, listName, strings.Join(names, ", "))
+}
 
-		fullURL := downloadRoot + rf.Name
-		response, connectionError := http.Get(fullURL)
-		if connectionError != nil {
-			fmt.Println(connectionError)
-			downloadErrors++
-			continue
+// updateAllRepos runs the updater again for each repository of the list, so
+// that every one gets its own directory, config file, lock and cache. The
+// Run commands are left out, and it stops at the first run interrupted with
+// ctrl+c. It returns the exit code of the first run that failed. With asJSON
+// only the reports go to stdout.
+func updateAllRepos(repos []namedRepo, asJSON bool) int {
+	var status io.Writer = os.Stdout
+	if asJSON {
+		status = os.Stderr
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(status, err)
+		return 1
+	}
+	// the runs get ctrl+c themselves, the list only has to stop after one
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+
+	exitCode := 0
+	var failed []string
+	for i, repo := range repos {
+		if i > 0 {
+			fmt.Fprintln(status, "")
+		}
+		fmt.Fprintf(status, "==== %s (%d/%d) ====\n", repo.Name, i+1, len(repos))
+		args := append(append([]string{}, os.Args[1:]...), "-allRepos=false", "-repo", repo.Name, "-noPause", "-run=")
+		command := exec.Command(executable, args...)
+		command.Stdin, command.Stdout, command.Stderr = os.Stdin, os.Stdout, os.Stderr
+		var code int
+		if runError := command.Run(); runError != nil && command.ProcessState == nil {
+			fmt.Fprintln(status, runError)
+			code = 1
+		} else if code = command.ProcessState.ExitCode(); code < 0 {
+			// killed by a signal, such as a second ctrl+c
+			code = exitInterrupted
 		}
+		if code != 0 {
+			failed = append(failed, repo.Name)
+			if exitCode == 0 {
+				exitCode = code
+			}
+		}
+		select {
+		case <-interrupted:
+			fmt.Fprintln(status, "Interrupted, not updating the rest of the repositories")
+			return exitInterrupted
+		default:
+		}
+		if code == exitInterrupted {
+			return exitInterrupted
+		}
+	}
+	fmt.Fprintln(status, "")
+	if len(failed) > 0 {
+		fmt.Fprintf(status, "Updated %d of %d repositories, %s did not succeed\n", len(repos)-len(failed), len(repos), strings.Join(failed, ", "))
+	} else {
+		fmt.Fprintf(status, "Updated all %d repositories\n", len(repos))
+	}
+	return exitCode
+}
 
-		if response.StatusCode != 200 {
-			fmt.Println("HTTP", response.StatusCode)
-			downloadErrors++
-			continue
+func flagWasSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
 		}
+	})
+	return set
+}
 
-		// create file if doesn't exist, truncate any existing bytes
-		downloadTarget, openError := os.OpenFile(rf.Name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-		if openError != nil {
-			fmt.Println(openError)
-			downloadErrors++
+// loadFlagEnvs sets the flags of flagEnvs that were not given on the
+// command line from the environment
+func loadFlagEnvs() error {
+	for name, envName := range flagEnvs {
+		value := os.Getenv(envName)
+		if len(value) == 0 || flagWasSet(name) {
 			continue
 		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s: %v", envName, err)
+		}
+	}
+	return nil
+}
 
-		reader := bufio.NewReader(response.Body)
-		_, writeError := reader.WriteTo(downloadTarget)
-		if writeError == nil {
-			// seek to beginning or the next CheckHash fails
-			downloadTarget.Seek(0, os.SEEK_SET)
+// parseTime reads a date, a date and time in local time, or an RFC 3339
+// time with its zone
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04", "2006-01-02T15:04:05"} {
+		if parsed, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return parsed, nil
+		}
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date like 2024-06-01 or a time like 2024-06-01T18:00:00Z", value)
+	}
+	return parsed, nil
+}
 
-			if rf.CheckHash(downloadTarget) {
-				fmt.Println("OK")
-			} else {
-				fmt.Println("Checksum failed")
-				downloadErrors++
-			}
-		} else {
-			fmt.Println(writeError)
-			downloadErrors++
+func flagOrEnv(value string, envName string) string {
+	if len(value) > 0 {
+		return value
+	}
+	return os.Getenv(envName)
+}
+
+// splitPatterns splits a comma separated flag value, leaving out empty items
+func splitPatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); len(pattern) > 0 {
+			patterns = append(patterns, pattern)
 		}
+	}
+	return patterns
+}
 
-		downloadTarget.Close()
-		response.Body.Close()
+// exitCodeFor is 0 when the run did everything it was asked to
+func exitCodeFor(report *updater.Report, err error, options updater.UpdateOptions) int {
+	switch {
+	case report.Interrupted:
+		return exitInterrupted
+	case errors.Is(err, updater.ErrDiskFull):
+		return exitDiskFull
+	case errors.Is(err, updater.ErrUnreachable), errors.Is(err, updater.ErrInvalidManifest), errors.Is(err, updater.ErrEmptyRepository):
+		return exitManifest
+	case errors.Is(err, updater.ErrLocked):
+		return exitLocked
+	case err != nil:
+		return 1
+	case options.Verify && mismatches(report) > 0:
+		return 1
+	case report.Errors > 0, len(report.Unverified) > 0:
+		return 1
 	}
-	fmt.Println("")
+	return 0
+}
 
-	if downloadErrors > 0 {
-		fmt.Printf("Completed with %d errors\n", downloadErrors)
-	} else {
+// printSummary explains the outcome of the run and returns the exit code
+func printSummary(report *updater.Report, err error, options updater.UpdateOptions) int {
+	fmt.Println("")
+	printFailures(report)
+	switch {
+	case report.Interrupted:
+		fmt.Printf("Interrupted, %d files completed. Run the updater again to finish the update\n", len(report.Downloaded))
+	case errors.Is(err, updater.ErrUnreachable):
+		fmt.Println(err)
+		fmt.Println("Could not reach the repository, check your internet connection or try again later. Nothing was changed")
+	case errors.Is(err, updater.ErrEmptyRepository):
+		fmt.Println(err)
+		fmt.Println("The repository is empty, which is probably a mistake on the server. Nothing was changed")
+	case errors.Is(err, updater.ErrDiskFull):
+		fmt.Println(err)
+		fmt.Println("The disk is full. Free up some space and run the updater again to download the rest")
+	case errors.Is(err, updater.ErrTooManyErrors):
+		fmt.Println(err)
+		fmt.Println("Check your internet connection or try again later, the files already downloaded are kept")
+	case err != nil:
+		fmt.Println(err)
+	case options.Verify:
+		if mismatches(report) > 0 {
+			fmt.Printf("%d of %d files do not match the repository\n", mismatches(report), mismatches(report)+len(report.Unchanged))
+		} else {
+			fmt.Println("All files match the repository")
+		}
+		if len(report.OptionalMissing) > 0 {
+			fmt.Printf("%d optional files are not installed\n", len(report.OptionalMissing))
+		}
+	case options.DryRun:
+		fmt.Printf("Dry run: would download %d files, would remove %d files\n", len(report.Missing)+len(report.Changed), len(report.Pruned))
+	case report.Errors > 0:
+		printTotals(report)
+		fmt.Printf("Completed with %d errors\n", report.Errors)
+	case len(report.Unverified) > 0:
+		printTotals(report)
+		fmt.Printf("%d files still don't match the repository after the update, run the updater again\n", len(report.Unverified))
+	default:
+		printTotals(report)
 		fmt.Println("Done :-)")
 	}
+	return exitCodeFor(report, err, options)
+}
 
+// printChanges lists the files the run added, replaced and removed, or
+// would have with -dryRun
+func printChanges(report *updater.Report, dryRun bool) {
+	newFiles, updatedFiles := report.Missing, report.Changed
+	if !dryRun {
+		newFiles = onlyIn(newFiles, report.Downloaded)
+		updatedFiles = onlyIn(updatedFiles, report.Downloaded)
+	}
 	fmt.Println("")
-	fmt.Println("Press Enter to close")
-	bufio.NewReader(os.Stdin).ReadBytes('\n')
+	for _, group := range []struct {
+		title string
+		files []string
+	}{
+		{"New", newFiles},
+		{"Updated", updatedFiles},
+		{"Removed", report.Pruned},
+	} {
+		fmt.Printf("%s: %d files\n", group.title, len(group.files))
+		for _, name := range group.files {
+			fmt.Println("  " + name)
+		}
+	}
 }
 
-func getRepositoryContent() (string, []repositoryFile) {
-	var files []repositoryFile
-
-	response, connectionError := http.Get(repoURL)
-	if connectionError != nil {
-		fmt.Println(connectionError)
-		return "", nil
+// onlyIn returns the names that are also in filter
+func onlyIn(names []string, filter []string) []string {
+	var result []string
+	for _, name := range names {
+		for _, other := range filter {
+			if name == other {
+				result = append(result, name)
+				break
+			}
+		}
 	}
+	return result
+}
 
-	if response.StatusCode != 200 {
-		fmt.Println("Unable to get repository data from", repoURL)
-		fmt.Println("HTTP status code", response.StatusCode)
-		return "", nil
+// printTotals tells how much the run did and how long it took
+func printTotals(report *updater.Report) {
+	elapsed := report.Elapsed.Round(time.Millisecond)
+	if elapsed > time.Second {
+		elapsed = elapsed.Round(time.Second)
 	}
+	if len(report.Downloaded) > 0 {
+		var rate int64
+		if seconds := report.Elapsed.Seconds(); seconds > 0 {
+			rate = int64(float64(report.DownloadedBytes) / seconds)
+		}
+		fmt.Printf("Downloaded %d files (%s) in %v, average %s/s\n", len(report.Downloaded), updater.FormatBytes(report.DownloadedBytes), elapsed, updater.FormatBytes(rate))
+	} else {
+		fmt.Printf("Nothing to download, checked in %v\n", elapsed)
+	}
+	fmt.Printf("Unchanged %d, pruned %d, failed %d\n", len(report.Unchanged), len(report.Pruned), len(report.Failed))
+	if len(report.WouldPrune) > 0 {
+		fmt.Printf("Would remove %d files that are not part of the repository, use -prune without -pruneDryRun to remove them\n", len(report.WouldPrune))
+	}
+	if len(report.Kept) > 0 {
+		fmt.Printf("Kept %d files that differ from the repository but have not changed since -changedSince\n", len(report.Kept))
+	}
+	if len(report.Optional) > 0 {
+		checked := len(report.Unchanged) + len(report.Missing) + len(report.Changed) + len(report.Kept) + len(report.Skipped) + len(report.OptionalMissing)
+		fmt.Printf("Required files %d, optional files %d: %d installed, %d skipped, %d failed\n", checked-len(report.Optional), len(report.Optional), len(report.Optional)-len(report.OptionalMissing)-len(report.OptionalFailed), len(report.OptionalMissing), len(report.OptionalFailed))
+	}
+}
+
+// printFailures lists every file that failed or couldn't be checked with the
+// reason, so a player can send the whole list to whoever runs the repository
+func printFailures(report *updater.Report) {
+	failures := append(append([]updater.FileError{}, report.Failed...), report.Skipped...)
+	printFileErrors(fmt.Sprintf("==== Failed files (%d) ====", len(failures)), failures)
+	// these don't make the install incomplete, but may still be wanted
+	printFileErrors(fmt.Sprintf("==== Optional files not downloaded (%d) ====", len(report.OptionalFailed)), report.OptionalFailed)
+}
 
-	repositoryBytes, readError := ioutil.ReadAll(response.Body)
-	if readError != nil {
-		fmt.Println(readError)
-		return "", nil
+// printFileErrors lists failures under heading, or nothing if there are none
+func printFileErrors(heading string, failures []updater.FileError) {
+	if len(failures) == 0 {
+		return
 	}
+	fmt.Println(heading)
+	for _, failure := range failures {
+		fmt.Println(failure.Name, ":", failure.Error)
+	}
+	fmt.Println(strings.Repeat("=", len(heading)))
+	fmt.Println("")
+}
 
-	data := repository{}
-	json.Unmarshal(repositoryBytes, &data)
+// mismatches counts the files that did not match the repository before the
+// run
+func mismatches(report *updater.Report) int {
+	return len(report.Missing) + len(report.Changed) + len(report.Skipped)
+}
 
-	for _, entry := range data.Files {
-		if len(entry) != 2 {
-			fmt.Println("Files entry does not contain 2 items")
-			continue
-		}
-		newEntry := repositoryFile{
-			Name: entry[0],
-			Hash: entry[1],
-		}
-		files = append(files, newEntry)
+// confirmPrune lists the files about to be pruned and asks the user whether
+// to remove them
+func confirmPrune(files []string) bool {
+	fmt.Println("These files are not part of the repository:")
+	for _, name := range files {
+		fmt.Println("  " + name)
+	}
+	if !isTerminal(os.Stdin) {
+		fmt.Println("Use -yes to prune when not running interactively")
+		return false
 	}
-	return data.DownloadRoot, files
+	return askConfirmation(fmt.Sprintf("Remove these %d files? [y/N] ", len(files)))
 }
 
-func calculateHash(f *os.File) string {
-	hash := sha1.New()
+func askConfirmation(question string) bool {
+	fmt.Print(question)
+	answer, _ := stdin.ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
 
-	reader := bufio.NewReader(f)
-	reader.WriteTo(hash)
+// pause keeps the console window open until the user presses enter. There
+// is nobody to press it when stdin isn't a terminal.
+func pause() {
+	if !isTerminal(os.Stdin) {
+		return
+	}
+	fmt.Println("")
+	fmt.Println("Press Enter to close")
+	stdin.ReadBytes('\n')
+}
 
-	calculated := hash.Sum(nil)
-	return hex.EncodeToString(calculated)
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
 }
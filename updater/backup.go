@@ -0,0 +1,160 @@
+package updater
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// BackupDirName holds a directory of the replaced files for every run made
+// with UpdateOptions.Backup, named by the time of the run
+const BackupDirName = ".updater-backup"
+
+// backupSetFormat names the backup directories. It sorts by time and
+// doesn't contain characters that windows refuses in file names
+const backupSetFormat = "20060102-150405"
+
+// TrashDirName holds the files pruned with UpdateOptions.PruneToTrash, in
+// a directory named by the time of the run like the backups
+const TrashDirName = ".updater-trash"
+
+func newBackupSet() string {
+	return filepath.Join(BackupDirName, time.Now().Format(backupSetFormat))
+}
+
+// backupFile saves the current version of the slash separated name under
+// setDir before it gets replaced. A hard link is enough because downloads
+// replace files by renaming instead of writing into them; copying is the
+// fallback for filesystems without links.
+func backupFile(setDir string, name string) error {
+	source := filepath.FromSlash(name)
+	if _, err := os.Stat(source); os.IsNotExist(err) {
+		return nil
+	}
+	target := filepath.Join(setDir, source)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	os.Remove(target)
+	if err := os.Link(source, target); err == nil {
+		return nil
+	}
+	return copyFile(source, target)
+}
+
+// trashFile moves the slash separated name under trashDir, keeping its path
+// relative to the current directory, and returns where it ended up
+func trashFile(trashDir string, name string) (string, error) {
+	source := filepath.FromSlash(name)
+	target := filepath.Join(trashDir, source)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return target, err
+	}
+	if err := os.Rename(source, target); err == nil {
+		return target, nil
+	}
+	// renaming fails when the trash is on another filesystem
+	if err := copyFile(source, target); err != nil {
+		return target, err
+	}
+	return target, os.Remove(source)
+}
+
+// copyFile copies source to target through a temp file, keeping the
+// modification time
+func copyFile(source string, target string) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	info, err := sourceFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	tempName := target + ".tmp"
+	targetFile, err := os.OpenFile(tempName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(targetFile, sourceFile); err != nil {
+		targetFile.Close()
+		os.Remove(tempName)
+		return err
+	}
+	if err := targetFile.Close(); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	os.Chtimes(tempName, info.ModTime(), info.ModTime())
+	return os.Rename(tempName, target)
+}
+
+// BackupSets lists the backups in the current directory, oldest first
+func BackupSets() ([]string, error) {
+	dirs, err := ioutil.ReadDir(BackupDirName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sets []string
+	for _, dir := range dirs {
+		if dir.IsDir() {
+			sets = append(sets, dir.Name())
+		}
+	}
+	return sets, nil
+}
+
+// Rollback puts back the files saved in the named backup set and returns
+// the slash separated names of the restored files. The progress is written
+// to out, which may be nil.
+func Rollback(set string, out io.Writer) ([]string, error) {
+	if out == nil {
+		out = ioutil.Discard
+	}
+	// only a set that is listed, so that a name like ".." can't lead
+	// anywhere else
+	sets, err := BackupSets()
+	if err != nil {
+		return nil, err
+	}
+	if !stringInSlice(set, sets) {
+		if len(sets) == 0 {
+			return nil, fmt.Errorf("no backup named %q, there are no backups", set)
+		}
+		return nil, fmt.Errorf("no backup named %q, available backups: %s", set, strings.Join(sets, ", "))
+	}
+	setDir := filepath.Join(BackupDirName, set)
+
+	var restored []string
+	walkError := filepath.Walk(setDir, func(currentPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(setDir, currentPath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relativePath)
+		fmt.Fprintln(out, "Restoring", name)
+		if err := os.MkdirAll(filepath.Dir(relativePath), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(currentPath, relativePath); err != nil {
+			return err
+		}
+		restored = append(restored, name)
+		return nil
+	})
+	return restored, walkError
+}
@@ -0,0 +1,34 @@
+package updater
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	chdirTemp(t)
+	writeFile(t, filepath.Join(BackupDirName, "20240102-030405", "mods", "a.txt"), "old")
+	writeFile(t, filepath.Join("mods", "a.txt"), "new")
+
+	restored, err := Rollback("20240102-030405", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || restored[0] != "mods/a.txt" {
+		t.Errorf("restored %v, want mods/a.txt", restored)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join("mods", "a.txt")); err != nil || string(content) != "old" {
+		t.Errorf("mods/a.txt has %q, %v", content, err)
+	}
+}
+
+func TestRollbackInvalidSet(t *testing.T) {
+	chdirTemp(t)
+	writeFile(t, filepath.Join(BackupDirName, "20240102-030405", "a.txt"), "old")
+	for _, set := range []string{"", ".", "..", "../" + BackupDirName + "/20240102-030405", "missing"} {
+		if restored, err := Rollback(set, nil); err == nil {
+			t.Errorf("Rollback(%q) restored %v", set, restored)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBlockSize is used when CreateOptions.BlockSize is not set
+const DefaultBlockSize = 4 << 20
+
+// MaxBlockSize limits the memory a repair needs. A file with larger blocks is
+// downloaded whole instead
+const MaxBlockSize = 64 << 20
+
+// A large file can list the hash of every block of BlockSize bytes. A copy
+// of the right size that fails its checksum is then repaired by downloading
+// only the blocks that differ with Range requests, instead of all of it.
+
+// hasBlocks reports whether the file can be repaired block by block.
+// Compressed and text files are served and hashed differently than they
+// are stored.
+func (f File) hasBlocks() bool {
+	if f.BlockSize <= 0 || f.BlockSize > MaxBlockSize || f.Size <= 0 || len(f.Compression) > 0 || f.NormalizeText {
+		return false
+	}
+	return int64(len(f.Blocks)) == (f.Size+f.BlockSize-1)/f.BlockSize
+}
+
+// hashBlocks reads r to the end and returns its hash along with the hashes
+// of its blocks of blockSize bytes, the last one possibly shorter
+func hashBlocks(r io.Reader, algo string, blockSize int64) (string, []string, error) {
+	fileHash, err := NewHash(algo)
+	if err != nil {
+		return "", nil, err
+	}
+	var blocks []string
+	for {
+		blockHash, _ := NewHash(algo)
+		n, err := io.Copy(io.MultiWriter(fileHash, blockHash), io.LimitReader(r, blockSize))
+		if err != nil {
+			return "", nil, err
+		}
+		if n == 0 {
+			break
+		}
+		blocks = append(blocks, hex.EncodeToString(blockHash.Sum(nil)))
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), blocks, nil
+}
+
+// repairFile rebuilds rf in its temp file from the blocks of the existing
+// copy that still match, downloading the rest from downloadRoot. It fails
+// when there is nothing to repair from, and the caller downloads the whole
+// file instead.
+func (d *downloader) repairFile(downloadRoot string, rf File) (err error) {
+	tempName := rf.Name + ".tmp"
+	// a partial download is closer to done than a repair
+	if _, statError := os.Stat(tempName); statError == nil && !d.Options.NoResume {
+		return errors.New("resuming the partial download instead")
+	}
+	existing, openError := os.Open(filepath.FromSlash(rf.Name))
+	if openError != nil {
+		return openError
+	}
+	defer existing.Close()
+	if info, statError := existing.Stat(); statError != nil || info.Size() != rf.Size {
+		return errors.New("the size differs, so the blocks don't line up")
+	}
+
+	downloadTarget, openError := os.OpenFile(tempName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, defaultFileMode)
+	if openError != nil {
+		return openError
+	}
+	var counted int64
+	defer func() {
+		if err != nil {
+			downloadTarget.Close()
+			os.Remove(tempName)
+			d.Progress.Add(-counted)
+		}
+	}()
+
+	// copy the existing file, noting the blocks that have to be replaced
+	block := make([]byte, rf.BlockSize)
+	var damaged []int
+	for i, expected := range rf.Blocks {
+		n, readError := io.ReadFull(existing, block)
+		if readError != nil && readError != io.ErrUnexpectedEOF {
+			return readError
+		}
+		if hash, _ := CalculateHash(bytes.NewReader(block[:n]), rf.HashAlgo); hash != expected {
+			damaged = append(damaged, i)
+			continue
+		}
+		if _, writeError := downloadTarget.WriteAt(block[:n], int64(i)*rf.BlockSize); writeError != nil {
+			return writeError
+		}
+		d.Progress.Add(int64(n))
+		counted += int64(n)
+	}
+	if len(damaged) == len(rf.Blocks) {
+		return errors.New("none of the blocks match")
+	}
+
+	d.Progress.Println(fmt.Sprintf("Repairing %s, downloading %d of its %d blocks", rf.Name, len(damaged), len(rf.Blocks)))
+	fullURL, templateError := downloadURL(downloadRoot, rf)
+	if templateError != nil {
+		return templateError
+	}
+	for _, i := range damaged {
+		offset := int64(i) * rf.BlockSize
+		data := block[:min(rf.BlockSize, rf.Size-offset)]
+		if fetchError := d.fetchRange(fullURL, offset, data); fetchError != nil {
+			return fetchError
+		}
+		if hash, _ := CalculateHash(bytes.NewReader(data), rf.HashAlgo); hash != rf.Blocks[i] {
+			return fmt.Errorf("block %d from the server doesn't match its checksum", i)
+		}
+		if _, writeError := downloadTarget.WriteAt(data, offset); writeError != nil {
+			return writeError
+		}
+		d.Progress.Add(int64(len(data)))
+		counted += int64(len(data))
+		atomic.AddInt64(&d.BytesWritten, int64(len(data)))
+	}
+	d.Options.Logger.Debug("repaired", "file", rf.Name, "blocks", len(damaged), "of", len(rf.Blocks))
+	// blocks were written out of order, so the file is read back
+	return d.finishDownload(rf, tempName, downloadTarget, nil)
+}
+
+// fetchRange reads len(data) bytes at offset of the file at fullURL
+func (d *downloader) fetchRange(fullURL string, offset int64, data []byte) error {
+	timeout := d.Options.Timeout
+	// the request is cancelled when the body stalls, see timeoutReader
+	ctx, cancel := context.WithCancel(d.Context)
+	defer cancel()
+	stallTimer := time.AfterFunc(timeout, cancel)
+	defer stallTimer.Stop()
+
+	request, requestError := d.Options.newRequest(ctx, fullURL)
+	if requestError != nil {
+		return requestError
+	}
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(data))-1))
+	d.Options.Logger.Debug("downloading block", "url", fullURL, "offset", offset, "length", len(data))
+	response, connectionError := d.Options.Client.Do(request)
+	if connectionError != nil {
+		return connectionError
+	}
+	defer response.Body.Close()
+	if redirectError := checkRedirect(response); redirectError != nil {
+		return redirectError
+	}
+	if response.StatusCode != 206 {
+		return fmt.Errorf("HTTP %d, the server doesn't support Range requests", response.StatusCode)
+	}
+	if !strings.HasPrefix(response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+		return fmt.Errorf("unexpected Content-Range %q", response.Header.Get("Content-Range"))
+	}
+
+	var body io.Reader = &timeoutReader{reader: response.Body, timer: stallTimer, timeout: timeout}
+	if d.Limiter != nil {
+		body = &rateLimitedReader{reader: body, limiter: d.Limiter, ctx: ctx}
+	}
+	if _, readError := io.ReadFull(body, data); readError != nil {
+		if ctx.Err() != nil && d.Context.Err() == nil {
+			return fmt.Errorf("no data received for %v", timeout)
+		}
+		return readError
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHashBlocks(t *testing.T) {
+	content := strings.Repeat("0123456789", 25)
+	hash, blocks, err := hashBlocks(strings.NewReader(content), DefaultHashAlgo, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := CalculateHash(strings.NewReader(content), DefaultHashAlgo); hash != want {
+		t.Errorf("file hash %s, want %s", hash, want)
+	}
+	// the last block is shorter
+	for i, want := range []string{content[:100], content[100:200], content[200:]} {
+		if i >= len(blocks) {
+			t.Fatalf("%d blocks, want 3", len(blocks))
+		}
+		if wantHash, _ := CalculateHash(strings.NewReader(want), DefaultHashAlgo); blocks[i] != wantHash {
+			t.Errorf("block %d hash %s, want %s", i, blocks[i], wantHash)
+		}
+	}
+	if len(blocks) != 3 {
+		t.Errorf("%d blocks, want 3", len(blocks))
+	}
+}
+
+func TestUpdateRepairBlocks(t *testing.T) {
+	dir := chdirTemp(t)
+	const blockSize = 1024
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4*blockSize/16-10)
+	hash, blocks, err := hashBlocks(bytes.NewReader(content), DefaultHashAlgo, blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join("source", "big.bin"), string(content))
+
+	var mutex sync.Mutex
+	var ranges []string
+	files := http.FileServer(http.Dir(filepath.Join(dir, "source")))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mutex.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	repo := &Repository{
+		DownloadRoot: server.URL + "/",
+		HashAlgo:     DefaultHashAlgo,
+		Files:        []File{{Name: "big.bin", Hash: hash, Size: int64(len(content)), BlockSize: blockSize, Blocks: blocks}},
+	}
+	manifest := filepath.Join(dir, "updater.json")
+	if err := repo.Save(manifest); err != nil {
+		t.Fatal(err)
+	}
+	damaged := append([]byte{}, content...)
+	copy(damaged[2*blockSize+10:], "damage")
+	writeFile(t, filepath.Join("install", "big.bin"), string(damaged))
+	if err := os.Chdir("install"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Update(context.Background(), UpdateOptions{RepoURL: manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Downloaded) != 1 {
+		t.Errorf("downloaded %v, failed %v", report.Downloaded, report.Failed)
+	}
+	if repaired, err := ioutil.ReadFile("big.bin"); err != nil || !bytes.Equal(repaired, content) {
+		t.Errorf("big.bin was not repaired: %v", err)
+	}
+	if want := "bytes=2048-3071"; len(ranges) != 1 || ranges[0] != want {
+		t.Errorf("requested ranges %q, want only %s", ranges, want)
+	}
+}
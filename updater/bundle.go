@@ -0,0 +1,344 @@
+package updater
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBundleThreshold is used when UpdateOptions.BundleThreshold is not set
+const DefaultBundleThreshold = 20
+
+// Bundle is an archive of repository files served next to them, so that an
+// update needing many small files can fetch them with a single request.
+// Only the needed entries are extracted and each is checked against the
+// manifest like a normal download.
+type Bundle struct {
+	// relative to DownloadRoot and the mirrors, ending in .zip, .tar,
+	// .tar.gz or .tgz. Entries are named like the files in the manifest
+	Name string
+	// patterns of the files the bundle holds, see MatchGlob. Empty means
+	// all the files of the repository
+	Files []string `json:",omitempty"`
+}
+
+// holds reports whether rf can be taken from the bundle. Files with their
+// own download root are served from elsewhere.
+func (b Bundle) holds(rf File) bool {
+	if len(rf.DownloadRoot) > 0 {
+		return false
+	}
+	return len(b.Files) == 0 || matchesAny(b.Files, rf.Name)
+}
+
+func bundleFormat(name string) (string, error) {
+	lowerName := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lowerName, ".zip"):
+		return "zip", nil
+	case strings.HasSuffix(lowerName, ".tar"):
+		return "tar", nil
+	case strings.HasSuffix(lowerName, ".tar.gz"), strings.HasSuffix(lowerName, ".tgz"):
+		return "tar.gz", nil
+	}
+	return "", fmt.Errorf("unknown bundle format %q, expected .zip, .tar, .tar.gz or .tgz", name)
+}
+
+// downloadBundles extracts files from the bundles that hold at least
+// threshold of them. It returns the files that were installed and the ones
+// that still need to be downloaded one by one, because no bundle was used
+// for them or the bundle didn't work out.
+func (d *downloader) downloadBundles(bundles []Bundle, files []File, threshold int) (installed []File, remaining []File) {
+	remaining = files
+	if threshold < 0 {
+		return nil, remaining
+	}
+	for _, bundle := range bundles {
+		needed := map[string]File{}
+		var rest []File
+		for _, rf := range remaining {
+			if bundle.holds(rf) {
+				needed[rf.Name] = rf
+			} else {
+				rest = append(rest, rf)
+			}
+		}
+		if len(needed) == 0 || len(needed) < threshold {
+			continue
+		}
+		if d.Context.Err() != nil {
+			break
+		}
+
+		d.Progress.Println(fmt.Sprintf("Downloading bundle %s for %d files", bundle.Name, len(needed)))
+		done, err := d.extractBundle(bundle, needed)
+		// the files are not downloaded one by one either then
+		diskFull := d.stopIfDiskFull(err)
+		if err != nil && !diskFull {
+			d.Progress.Println(fmt.Sprintf("Downloading bundle %s failed : %v, downloading the files one by one", bundle.Name, err))
+			d.Options.Logger.Warn("bundle failed", "bundle", bundle.Name, "extracted", len(done), "error", err)
+		}
+		// keep the order of the manifest for the files left over
+		for _, rf := range remaining {
+			if _, inBundle := needed[rf.Name]; !inBundle {
+				continue
+			}
+			if done[rf.Name] {
+				d.Progress.FileDone("Downloading", rf.Name, nil)
+				installed = append(installed, rf)
+			} else {
+				rest = append(rest, rf)
+			}
+		}
+		if err == nil && len(done) < len(needed) {
+			d.Progress.Println(fmt.Sprintf("Bundle %s had no good copy of %d of the files, downloading them one by one", bundle.Name, len(needed)-len(done)))
+		}
+		remaining = rest
+		if diskFull {
+			break
+		}
+	}
+	return installed, remaining
+}
+
+// extractBundle tries the download roots in order until one of them serves
+// the bundle. It returns the names of the files installed from it, which
+// may be some of them even when the error is not nil.
+func (d *downloader) extractBundle(bundle Bundle, needed map[string]File) (map[string]bool, error) {
+	format, err := bundleFormat(bundle.Name)
+	if err != nil {
+		return nil, err
+	}
+	done := map[string]bool{}
+	for i, downloadRoot := range d.DownloadRoots {
+		if i > 0 {
+			d.Progress.Println(fmt.Sprintf("Downloading bundle %s failed : %v, trying mirror %s", bundle.Name, err, downloadRoot))
+			d.Options.Logger.Warn("trying mirror", "bundle", bundle.Name, "mirror", downloadRoot, "error", err)
+		}
+		if isTemplate(downloadRoot) {
+			err = errors.New("a templated download root has no place for bundles")
+			continue
+		}
+		err = d.extractBundleFrom(downloadRoot+bundle.Name, format, needed, done)
+		if err == nil || d.Context.Err() != nil || isDiskFull(err) {
+			break
+		}
+	}
+	return done, err
+}
+
+// extractBundleFrom installs the needed files found in the bundle at
+// fullURL and marks them in done. Entries that are not needed, or already
+// done by an earlier attempt, are skipped.
+func (d *downloader) extractBundleFrom(fullURL string, format string, needed map[string]File, done map[string]bool) error {
+	timeout := d.Options.Timeout
+	// the request is cancelled when the body stalls, see timeoutReader
+	ctx, cancel := context.WithCancel(d.Context)
+	defer cancel()
+	stallTimer := time.AfterFunc(timeout, cancel)
+	defer stallTimer.Stop()
+
+	request, requestError := d.Options.newRequest(ctx, fullURL)
+	if requestError != nil {
+		return requestError
+	}
+	d.Options.Logger.Debug("downloading bundle", "url", fullURL)
+	response, connectionError := d.Options.Client.Do(request)
+	if connectionError != nil {
+		return connectionError
+	}
+	defer response.Body.Close()
+	d.Options.Logger.Debug("bundle response", "url", fullURL, "status", response.StatusCode, "length", response.ContentLength)
+	if redirectError := checkRedirect(response); redirectError != nil {
+		return redirectError
+	}
+	if response.StatusCode != 200 {
+		return fmt.Errorf("HTTP %d", response.StatusCode)
+	}
+
+	var body io.Reader = &timeoutReader{reader: response.Body, timer: stallTimer, timeout: timeout}
+	if d.Limiter != nil {
+		body = &rateLimitedReader{reader: body, limiter: d.Limiter, ctx: ctx}
+	}
+	var err error
+	if format == "zip" {
+		err = d.extractZip(body, needed, done)
+	} else {
+		err = d.extractTar(body, format == "tar.gz", needed, done)
+	}
+	if err != nil && ctx.Err() != nil && d.Context.Err() == nil {
+		return fmt.Errorf("no data received for %v", timeout)
+	}
+	return err
+}
+
+// neededEntry returns the manifest file an archive entry is for, if it
+// still needs to be installed
+func neededEntry(entryName string, needed map[string]File, done map[string]bool) (File, bool) {
+	name := path.Clean(entryName)
+	rf, found := needed[name]
+	return rf, found && !done[name]
+}
+
+// extractTar streams the archive, so the needed files are installed while
+// the rest of it is still downloading
+func (d *downloader) extractTar(r io.Reader, gzipped bool, needed map[string]File, done map[string]bool) error {
+	if gzipped {
+		gzipReader, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("unable to decompress : %v", err)
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	}
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rf, found := neededEntry(header.Name, needed, done)
+		if !found || !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		if err := d.installEntry(rf, header.Size, tarReader); err != nil {
+			// a broken entry is downloaded on its own, but a broken stream
+			// ends the archive
+			d.Options.Logger.Warn("bundle entry failed", "file", rf.Name, "error", err)
+			if d.Context.Err() != nil || isDiskFull(err) {
+				return err
+			}
+			continue
+		}
+		done[rf.Name] = true
+	}
+}
+
+// maxZipSize is how much of a zip bundle is saved for the needed files:
+// twice their size, leaving room for the index and the entries that are
+// already up to date, and a megabyte more. Files without a size in the
+// manifest count as options.MaxFileSize. 0 means no limit, when neither is
+// known.
+func (d *downloader) maxZipSize(needed map[string]File) int64 {
+	var total int64
+	for _, rf := range needed {
+		size := rf.Size
+		if size <= 0 {
+			size = d.Options.MaxFileSize
+		}
+		if size <= 0 || size > math.MaxInt64/4-total {
+			return 0
+		}
+		total += size
+	}
+	return 2*total + 1<<20
+}
+
+// extractZip saves the archive to a temp file first, as zip keeps its index
+// at the end. An archive larger than maxZipSize is given up on.
+func (d *downloader) extractZip(r io.Reader, needed map[string]File, done map[string]bool) error {
+	archiveFile, err := os.CreateTemp(".", ".updater-bundle-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archiveFile.Name())
+	defer archiveFile.Close()
+	limit := d.maxZipSize(needed)
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	size, err := io.Copy(archiveFile, r)
+	if err != nil {
+		return err
+	}
+	if limit > 0 && size > limit {
+		return fmt.Errorf("bundle is larger than the %s expected for its files", FormatBytes(limit))
+	}
+	zipReader, err := zip.NewReader(archiveFile, size)
+	if err != nil {
+		return err
+	}
+	for _, entry := range zipReader.File {
+		if d.Context.Err() != nil {
+			return d.Context.Err()
+		}
+		rf, found := neededEntry(entry.Name, needed, done)
+		if !found || !entry.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		entryReader, err := entry.Open()
+		if err != nil {
+			d.Options.Logger.Warn("bundle entry failed", "file", rf.Name, "error", err)
+			continue
+		}
+		err = d.installEntry(rf, int64(entry.UncompressedSize64), entryReader)
+		entryReader.Close()
+		if err != nil {
+			d.Options.Logger.Warn("bundle entry failed", "file", rf.Name, "error", err)
+			if isDiskFull(err) {
+				return err
+			}
+			continue
+		}
+		done[rf.Name] = true
+	}
+	return nil
+}
+
+// installEntry writes an archive entry of size bytes to rf through a temp
+// file, checking it the same way as a single download
+func (d *downloader) installEntry(rf File, size int64, r io.Reader) (err error) {
+	if rf.Size > 0 && size != rf.Size {
+		return fmt.Errorf("bundle has %d bytes, expected %d", size, rf.Size)
+	}
+	if maxSize := d.Options.MaxFileSize; maxSize > 0 && size > maxSize {
+		return fileTooLarge(size, maxSize)
+	}
+	if makeDirError := makeParentDir(rf.Name); makeDirError != nil {
+		return makeDirError
+	}
+	tempName := rf.Name + ".tmp"
+	downloadTarget, openError := os.OpenFile(tempName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, defaultFileMode)
+	if openError != nil {
+		return openError
+	}
+	if rf.Size <= 0 {
+		d.Progress.AddTotal(size)
+	}
+	hasher, hashError := rf.newHasher()
+	if hashError != nil {
+		downloadTarget.Close()
+		os.Remove(tempName)
+		return hashError
+	}
+	counter := &progressReader{reader: r, progress: d.Progress}
+	defer func() {
+		if err != nil {
+			downloadTarget.Close()
+			os.Remove(tempName)
+			d.Progress.Add(-counter.count)
+		}
+	}()
+	written, writeError := io.Copy(io.MultiWriter(downloadTarget, hasher), counter)
+	atomic.AddInt64(&d.BytesWritten, written)
+	if writeError != nil {
+		return writeError
+	}
+	if written != size {
+		return fmt.Errorf("wrote %d bytes, expected %d", written, size)
+	}
+	d.Options.Logger.Debug("extracted", "file", rf.Name, "bytes", written)
+	return d.finishDownload(rf, tempName, downloadTarget, hasher)
+}
@@ -0,0 +1,195 @@
+package updater
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// bundleFiles are the contents of the files of the bundle tests by name
+var bundleFiles = map[string]string{
+	"mods/a.txt":        "a",
+	"mods/b.txt":        "bb",
+	"mods/addons/c.txt": "ccc",
+}
+
+func writeZip(t *testing.T, name string, files map[string]string) {
+	t.Helper()
+	var archive bytes.Buffer
+	zipWriter := zip.NewWriter(&archive)
+	for entryName, content := range files {
+		w, err := zipWriter.Create(entryName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zipWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, name, archive.String())
+}
+
+func writeTar(t *testing.T, name string, gzipped bool, files map[string]string) {
+	t.Helper()
+	var archive bytes.Buffer
+	var tarWriter *tar.Writer
+	var gzipWriter *gzip.Writer
+	if gzipped {
+		gzipWriter = gzip.NewWriter(&archive)
+		tarWriter = tar.NewWriter(gzipWriter)
+	} else {
+		tarWriter = tar.NewWriter(&archive)
+	}
+	for entryName, content := range files {
+		header := &tar.Header{Name: entryName, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tarWriter.Write([]byte(content))
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, name, archive.String())
+}
+
+// bundleRepository saves a manifest of bundleFiles with the bundle name,
+// served from the source directory, and moves into an empty install
+// directory. It returns the manifest.
+func bundleRepository(t *testing.T, dir string, bundle string) string {
+	t.Helper()
+	repo := &Repository{
+		DownloadRoot: filepath.Join(dir, "source"),
+		HashAlgo:     DefaultHashAlgo,
+		Bundles:      []Bundle{{Name: bundle}},
+	}
+	for name, content := range bundleFiles {
+		hash, err := CalculateHash(strings.NewReader(content), DefaultHashAlgo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo.Files = append(repo.Files, File{Name: name, Hash: hash, Size: int64(len(content))})
+	}
+	manifest := filepath.Join(dir, "updater.json")
+	if err := repo.Save(manifest); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join("install", ".keep"), "")
+	if err := os.Chdir("install"); err != nil {
+		t.Fatal(err)
+	}
+	return manifest
+}
+
+func checkBundleFiles(t *testing.T, report *Report) {
+	t.Helper()
+	if len(report.Downloaded) != len(bundleFiles) {
+		t.Errorf("downloaded %v, failed %v", report.Downloaded, report.Failed)
+	}
+	for name, content := range bundleFiles {
+		if got, err := ioutil.ReadFile(filepath.FromSlash(name)); err != nil || string(got) != content {
+			t.Errorf("%s has %q, %v", name, got, err)
+		}
+	}
+}
+
+func TestUpdateBundles(t *testing.T) {
+	for _, bundle := range []string{"files.zip", "files.tar", "files.tar.gz", "files.tgz"} {
+		t.Run(bundle, func(t *testing.T) {
+			dir := chdirTemp(t)
+			// only the bundle is served, so the files can't come one by one
+			bundleName := filepath.Join("source", bundle)
+			switch {
+			case strings.HasSuffix(bundle, ".zip"):
+				writeZip(t, bundleName, bundleFiles)
+			case strings.HasSuffix(bundle, ".tar"):
+				writeTar(t, bundleName, false, bundleFiles)
+			default:
+				writeTar(t, bundleName, true, bundleFiles)
+			}
+			manifest := bundleRepository(t, dir, bundle)
+			report, err := Update(context.Background(), UpdateOptions{RepoURL: manifest, BundleThreshold: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkBundleFiles(t, report)
+		})
+	}
+}
+
+func TestUpdateBundleBrokenEntry(t *testing.T) {
+	dir := chdirTemp(t)
+	files := map[string]string{"mods/a.txt": "a", "mods/b.txt": "not b", "mods/addons/c.txt": "ccc"}
+	writeTar(t, filepath.Join("source", "files.tar"), false, files)
+	// the entry that doesn't match is downloaded on its own
+	writeFile(t, filepath.Join("source", "mods", "b.txt"), bundleFiles["mods/b.txt"])
+	manifest := bundleRepository(t, dir, "files.tar")
+	report, err := Update(context.Background(), UpdateOptions{RepoURL: manifest, BundleThreshold: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBundleFiles(t, report)
+}
+
+func TestUpdateZipBundleTooLarge(t *testing.T) {
+	dir := chdirTemp(t)
+	// random bytes don't compress, so the archive stays large
+	padding := make([]byte, 2<<20)
+	rand.New(rand.NewSource(1)).Read(padding)
+	files := map[string]string{"padding.bin": string(padding)}
+	for name, content := range bundleFiles {
+		files[name] = content
+	}
+	writeZip(t, filepath.Join("source", "files.zip"), files)
+	for name, content := range bundleFiles {
+		writeFile(t, filepath.Join("source", filepath.FromSlash(name)), content)
+	}
+	manifest := bundleRepository(t, dir, "files.zip")
+	var output bytes.Buffer
+	report, err := Update(context.Background(), UpdateOptions{RepoURL: manifest, BundleThreshold: 2, Output: &output})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "bundle is larger than") {
+		t.Errorf("bundle larger than its files was used:\n%s", output.String())
+	}
+	checkBundleFiles(t, report)
+}
+
+func TestMaxZipSize(t *testing.T) {
+	for _, test := range []struct {
+		sizes       []int64
+		maxFileSize int64
+		want        int64
+	}{
+		{[]int64{100, 200}, 0, 2*300 + 1<<20},
+		{[]int64{100, 0}, 1000, 2*1100 + 1<<20},
+		{[]int64{100, 0}, 0, 0},
+		{[]int64{1 << 62, 1 << 62}, 0, 0},
+	} {
+		needed := map[string]File{}
+		for i, size := range test.sizes {
+			name := fmt.Sprint(i)
+			needed[name] = File{Name: name, Size: size}
+		}
+		d := &downloader{Options: UpdateOptions{MaxFileSize: test.maxFileSize}}
+		if got := d.maxZipSize(needed); got != test.want {
+			t.Errorf("maxZipSize of %v with MaxFileSize %d = %d, want %d", test.sizes, test.maxFileSize, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package updater
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// hashCache maps file names to the hash they had when their size and
+// modification time were last seen. Any change to a file updates its
+// modification time, so a matching entry can be trusted without reading the
+// file again. It also keeps the last manifest fetched from each address, so
+// an unchanged manifest doesn't have to be downloaded again.
+type hashCache struct {
+	mutex     sync.Mutex
+	path      string
+	Entries   map[string]hashCacheEntry
+	Manifests map[string]manifestCacheEntry `json:",omitempty"`
+	// files being downloaded, with the hash they are downloaded for. Left
+	// over from a run that was killed, they are downloaded again without
+	// hashing the local copy first
+	Pending map[string]string `json:",omitempty"`
+	// the release installed from each repository address, see delta.go
+	Releases map[string]installedRelease `json:",omitempty"`
+}
+
+type hashCacheEntry struct {
+	Size     int64
+	ModTime  int64
+	HashAlgo string
+	Hash     string
+}
+
+// manifestCacheEntry is a manifest with the validators the server sent for
+// it, see fetchManifest
+type manifestCacheEntry struct {
+	// where the manifest was read from after redirects
+	ResolvedURL  string
+	ETag         string `json:",omitempty"`
+	LastModified string `json:",omitempty"`
+	Body         []byte
+}
+
+// loadHashCache reads the cache from path. A missing or unreadable cache is
+// not an error, it just means every file gets hashed again.
+func loadHashCache(path string) *hashCache {
+	cache := &hashCache{path: path}
+	if cacheBytes, readError := ioutil.ReadFile(path); readError == nil {
+		json.Unmarshal(cacheBytes, cache)
+	}
+	if cache.Entries == nil {
+		cache.Entries = make(map[string]hashCacheEntry)
+	}
+	if cache.Manifests == nil {
+		cache.Manifests = make(map[string]manifestCacheEntry)
+	}
+	if cache.Pending == nil {
+		cache.Pending = make(map[string]string)
+	}
+	if cache.Releases == nil {
+		cache.Releases = make(map[string]installedRelease)
+	}
+	return cache
+}
+
+func (c *hashCache) LookupManifest(manifestURL string) (manifestCacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, found := c.Manifests[manifestURL]
+	return entry, found
+}
+
+func (c *hashCache) StoreManifest(manifestURL string, entry manifestCacheEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Manifests[manifestURL] = entry
+}
+
+// Lookup returns the cached hash for name if the file still has the same
+// size and modification time
+func (c *hashCache) Lookup(name string, info os.FileInfo, hashAlgo string) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, found := c.Entries[name]
+	if !found || entry.Size != info.Size() || entry.ModTime != info.ModTime().UnixNano() || entry.HashAlgo != hashAlgo {
+		return "", false
+	}
+	return entry.Hash, true
+}
+
+// Store records the hash of a file. The file is no longer pending, as its
+// hash is known.
+func (c *hashCache) Store(name string, info os.FileInfo, hashAlgo string, hash string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.Pending, name)
+	c.Entries[name] = hashCacheEntry{
+		Size:     info.Size(),
+		ModTime:  info.ModTime().UnixNano(),
+		HashAlgo: hashAlgo,
+		Hash:     hash,
+	}
+}
+
+// MarkPending records that the files are about to be downloaded. It is
+// cleared by Store once a file is in place.
+func (c *hashCache) MarkPending(files []File) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, rf := range files {
+		c.Pending[rf.Name] = rf.Hash
+	}
+}
+
+// IsPending reports whether an earlier run was interrupted while
+// downloading this version of rf
+func (c *hashCache) IsPending(rf File) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	hash, found := c.Pending[rf.Name]
+	return found && hash == rf.Hash
+}
+
+// InstalledRelease returns the release last installed from repoURL
+func (c *hashCache) InstalledRelease(repoURL string) (installedRelease, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	installed, found := c.Releases[repoURL]
+	return installed, found
+}
+
+// SetInstalledRelease records the release installed from repoURL. Without
+// one, an earlier release is forgotten.
+func (c *hashCache) SetInstalledRelease(repoURL string, installed installedRelease) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(installed.Release) == 0 || len(installed.Deltas) == 0 {
+		delete(c.Releases, repoURL)
+		return
+	}
+	c.Releases[repoURL] = installed
+}
+
+func (c *hashCache) Save() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cacheBytes, marshalError := json.Marshal(c)
+	if marshalError != nil {
+		return marshalError
+	}
+	return ioutil.WriteFile(c.path, cacheBytes, 0644)
+}
@@ -0,0 +1,54 @@
+package updater
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// On a filesystem that ignores case, such as the defaults of Windows and
+// macOS, two manifest entries differing only in case are the same file. Each
+// update would overwrite one with the other and download both again on the
+// next run, so a manifest like that is refused instead.
+
+// caseInsensitive reports whether names in the current directory ignore
+// case. It is found out by creating a file and looking it up in upper case,
+// and when that can't be done, guessed from the operating system.
+func caseInsensitive() bool {
+	probe, err := os.CreateTemp(".", ".updater-case-*.tmp")
+	if err != nil {
+		return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+	}
+	name := probe.Name()
+	probe.Close()
+	defer os.Remove(name)
+	upper := strings.ToUpper(name)
+	if upper == name {
+		return runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+	}
+	_, statError := os.Stat(upper)
+	return statError == nil
+}
+
+// checkCaseCollisions fails if files has entries whose names only differ in
+// case, naming every such group
+func checkCaseCollisions(files []File) error {
+	groups := map[string][]string{}
+	var collisions []string
+	for _, rf := range files {
+		folded := strings.ToLower(rf.Name)
+		groups[folded] = append(groups[folded], rf.Name)
+		if len(groups[folded]) == 2 {
+			collisions = append(collisions, folded)
+		}
+	}
+	if len(collisions) == 0 {
+		return nil
+	}
+	descriptions := make([]string, len(collisions))
+	for i, folded := range collisions {
+		descriptions[i] = strings.Join(groups[folded], " and ")
+	}
+	return fmt.Errorf("the repository lists files that are the same file on this case-insensitive filesystem, rename them in the manifest: %s", strings.Join(descriptions, ", "))
+}
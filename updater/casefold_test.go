@@ -0,0 +1,38 @@
+package updater
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckCaseCollisions(t *testing.T) {
+	for _, test := range []struct {
+		names []string
+		// the groups named in the error, empty when there is no error
+		collisions []string
+	}{
+		{[]string{"a.txt", "b.txt", "mods/a.txt"}, nil},
+		{[]string{"a.txt", "A.txt"}, []string{"a.txt and A.txt"}},
+		{[]string{"Mods/a.txt", "mods/A.TXT", "mods/a.TXT", "b.txt"}, []string{"Mods/a.txt and mods/A.TXT and mods/a.TXT"}},
+		{[]string{"a.txt", "A.txt", "b.txt", "B.txt"}, []string{"a.txt and A.txt", "b.txt and B.txt"}},
+	} {
+		var files []File
+		for _, name := range test.names {
+			files = append(files, File{Name: name})
+		}
+		err := checkCaseCollisions(files)
+		if len(test.collisions) == 0 {
+			if err != nil {
+				t.Errorf("checkCaseCollisions(%v) = %v", test.names, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("checkCaseCollisions(%v) found no collisions", test.names)
+			continue
+		}
+		if !strings.HasSuffix(err.Error(), ": "+strings.Join(test.collisions, ", ")) {
+			t.Errorf("checkCaseCollisions(%v) = %v, want it to name %v", test.names, err, test.collisions)
+		}
+	}
+}
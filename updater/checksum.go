@@ -0,0 +1,50 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// ChecksumSuffix is appended to the manifest name or address to get its
+// SHA-256 checksum, written in the format of sha256sum
+const ChecksumSuffix = ".sha256"
+
+// manifestChecksum formats the checksum file of a manifest saved as name
+func manifestChecksum(repositoryBytes []byte, name string) []byte {
+	sum := sha256.Sum256(repositoryBytes)
+	return []byte(hex.EncodeToString(sum[:]) + "  " + name + "\n")
+}
+
+// checkManifestChecksum compares the manifest against the checksum served
+// next to it, catching a truncated or corrupted download before it is used
+// to decide what to download and prune. Without a checksum the manifest is
+// used as is.
+func checkManifestChecksum(ctx context.Context, options UpdateOptions, manifestURL string, repositoryBytes []byte) error {
+	checksumBytes, _, fetchError := fetchManifest(ctx, options, manifestURL+ChecksumSuffix, nil)
+	if fetchError != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		fmt.Fprintf(options.Output, "Warning: no manifest checksum at %s, a broken download can't be detected\n", manifestURL+ChecksumSuffix)
+		options.Logger.Warn("manifest has no checksum, its integrity is not checked", "url", manifestURL+ChecksumSuffix, "error", fetchError)
+		return nil
+	}
+	// only the hash matters, the name after it is the one it was saved as
+	fields := bytes.Fields(checksumBytes)
+	if len(fields) == 0 {
+		return fmt.Errorf("manifest checksum %s is empty", manifestURL+ChecksumSuffix)
+	}
+	expected, decodeError := hex.DecodeString(string(fields[0]))
+	if decodeError != nil || len(expected) != sha256.Size {
+		return fmt.Errorf("manifest checksum %s is not a SHA-256 hash", manifestURL+ChecksumSuffix)
+	}
+	sum := sha256.Sum256(repositoryBytes)
+	options.Logger.Debug("compared manifest checksum", "url", manifestURL, "local", hex.EncodeToString(sum[:]), "expected", hex.EncodeToString(expected))
+	if !bytes.Equal(sum[:], expected) {
+		return fmt.Errorf("manifest checksum mismatch, the download of %d bytes is truncated or corrupted", len(repositoryBytes))
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package updater
+
+import (
+	"io"
+	"regexp"
+)
+
+// ANSI colors of the file statuses, see UpdateOptions.Color
+const (
+	colorOK      = "32"
+	colorChanged = "33"
+	colorFailed  = "31"
+)
+
+var colorPattern = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// colored wraps text in the ANSI codes of color when enabled
+func colored(enabled bool, color string, text string) string {
+	if !enabled {
+		return text
+	}
+	return "\x1b[" + color + "m" + text + "\x1b[0m"
+}
+
+// StripColors returns a writer that removes the colors from everything
+// written to w, e.g. for a log file that gets the same output as the
+// terminal. The colors of a line arrive in a single write
+func StripColors(w io.Writer) io.Writer {
+	return colorStripper{w}
+}
+
+type colorStripper struct {
+	writer io.Writer
+}
+
+func (s colorStripper) Write(b []byte) (int, error) {
+	if _, err := s.writer.Write(colorPattern.ReplaceAll(b, nil)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
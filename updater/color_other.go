@@ -0,0 +1,11 @@
+//go:build !windows
+
+package updater
+
+import "os"
+
+// EnableColor reports whether the terminal f understands ANSI colors, which
+// all but the dumb ones do
+func EnableColor(f *os.File) bool {
+	return os.Getenv("TERM") != "dumb"
+}
@@ -0,0 +1,71 @@
+package updater
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// CompressionGzip serves files gzipped with a .gz suffix. The manifest still
+// lists the name, size and hash of the decompressed file.
+const CompressionGzip = "gzip"
+
+// compressedSuffix returns what is appended to the name of a file on the
+// server. zstd would need a library outside of the standard one, so it is
+// reported as unsupported like any other unknown compression.
+func compressedSuffix(compression string) (string, error) {
+	switch compression {
+	case "":
+		return "", nil
+	case CompressionGzip:
+		return ".gz", nil
+	}
+	return "", fmt.Errorf("unsupported compression %q", compression)
+}
+
+// decompress wraps r so that reading it returns the decompressed file
+func decompress(compression string, r io.Reader) (io.Reader, error) {
+	switch compression {
+	case "":
+		return r, nil
+	case CompressionGzip:
+		return gzip.NewReader(r)
+	}
+	return nil, fmt.Errorf("unsupported compression %q", compression)
+}
+
+// SaveGzipped writes a gzipped copy of the file name to name + ".gz", such
+// as a manifest for a server that sends the copy to clients accepting gzip
+// instead of compressing the file on every request. The copy is written
+// next to the file and renamed over the old one, so a server never sends a
+// half written copy.
+func SaveGzipped(name string) (err error) {
+	source, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	tempName := name + ".gz.tmp"
+	target, err := os.Create(tempName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			target.Close()
+			os.Remove(tempName)
+		}
+	}()
+	writer, _ := gzip.NewWriterLevel(target, gzip.BestCompression)
+	if _, err = io.Copy(writer, source); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	if err = target.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempName, name+".gz")
+}
@@ -0,0 +1,310 @@
+package updater
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDownloadRoot is the DownloadRoot of a new manifest when neither
+// CreateOptions.DownloadRoot nor an earlier manifest sets one
+const DefaultDownloadRoot = "https://koti.kapsi.fi/darkon/polloeskadroona/repo/"
+
+// CreateOptions configures CreateRepository
+type CreateOptions struct {
+	HashAlgo string
+	// number of files hashed in parallel
+	Concurrency int
+	// receives a line for every file added, nil discards them
+	Output io.Writer
+	// files and directories matching these are left out
+	Ignore *IgnoreRules
+	// left out regardless of Ignore, such as the manifest being written
+	Exclude []string
+	// files matching these patterns are hashed as text, see
+	// Repository.TextFiles. nil keeps the patterns of Previous
+	TextFiles []string
+	// files at least this large also get the hashes of their blocks of
+	// BlockSize bytes, see File.Blocks. 0 doesn't hash blocks
+	BlockThreshold int64
+	// DefaultBlockSize if not set, at most MaxBlockSize
+	BlockSize int64
+	// an earlier manifest of the same directories. Files whose size and
+	// modification time still match it keep their hash without being read,
+	// and its download roots, compression, bundles, includes, prune
+	// exclusions, managed paths, post-download commands and deltas carry
+	// over. The Release doesn't
+	Previous *Repository
+	// Release of the new manifest, see Repository.Release
+	Release string
+	// where the files are downloaded from, a slash is added to the end
+	// unless it is a template. Empty keeps the one of Previous
+	DownloadRoot string
+	// relative directory of bsdiff patches, served at the same place under
+	// the download root. The patches of a file are found as
+	// PatchDir/<hash>/<hash of the earlier copy>.bsdiff, see Patch
+	PatchDir string
+}
+
+// CreateRepository builds a manifest of every file under directoryNames.
+// The files are sorted by name so the result doesn't depend on the order
+// the filesystem or the workers return them in. Files that can't be read
+// are reported to options.Output and left out, as are the files matching
+// options.Ignore or options.Exclude. Symlinks are recorded as links without
+// following them, and left out when they point outside of the repository.
+func CreateRepository(directoryNames []string, options CreateOptions) (*Repository, error) {
+	if len(options.HashAlgo) == 0 && options.Previous != nil {
+		options.HashAlgo = options.Previous.HashAlgo
+	}
+	if len(options.HashAlgo) == 0 {
+		options.HashAlgo = DefaultHashAlgo
+	}
+	if _, err := NewHash(options.HashAlgo); err != nil {
+		return nil, err
+	}
+	if options.Concurrency < 1 {
+		options.Concurrency = 1
+	}
+	if options.BlockSize <= 0 {
+		options.BlockSize = DefaultBlockSize
+	}
+	if options.BlockSize > MaxBlockSize {
+		return nil, fmt.Errorf("block size %s is larger than the limit of %s", FormatBytes(options.BlockSize), FormatBytes(MaxBlockSize))
+	}
+	out := options.Output
+	if out == nil {
+		out = ioutil.Discard
+	}
+
+	// an empty repository is written as "Files": [] rather than null
+	newRepo := &Repository{Version: ManifestVersion, Files: []File{}}
+	newRepo.DownloadRoot = DefaultDownloadRoot
+	newRepo.HashAlgo = options.HashAlgo
+	newRepo.Release = options.Release
+	newRepo.Built = time.Now().Unix()
+
+	previousFiles := map[string]File{}
+	var previousTextFiles []string
+	// files of unknown age are taken as changed now
+	previousBuilt := newRepo.Built
+	if previous := options.Previous; previous != nil {
+		previousTextFiles = previous.TextFiles
+		if options.TextFiles == nil {
+			options.TextFiles = previous.TextFiles
+		}
+		newRepo.DownloadRoot = previous.DownloadRoot
+		newRepo.Mirrors = previous.Mirrors
+		newRepo.Compression = previous.Compression
+		newRepo.MinUpdaterVersion = previous.MinUpdaterVersion
+		newRepo.UpdaterURL = previous.UpdaterURL
+		newRepo.Run = previous.Run
+		newRepo.Bundles = previous.Bundles
+		newRepo.Include = previous.Include
+		newRepo.PruneExclude = previous.PruneExclude
+		newRepo.Managed = previous.Managed
+		newRepo.PostDownload = previous.PostDownload
+		newRepo.Deltas = previous.Deltas
+		if previous.Built > 0 {
+			previousBuilt = previous.Built
+		}
+		previousHashAlgo := previous.HashAlgo
+		if len(previousHashAlgo) == 0 {
+			previousHashAlgo = DefaultHashAlgo
+		}
+		// hashes made with another algorithm are of no use
+		if previousHashAlgo == options.HashAlgo {
+			for _, previousFile := range previous.Files {
+				previousFiles[previousFile.Name] = previousFile
+			}
+		}
+	}
+	if downloadRoot := options.DownloadRoot; len(downloadRoot) > 0 {
+		if err := checkTemplate(downloadRoot); err != nil {
+			return nil, err
+		}
+		// names are appended to the root as they are
+		if !isTemplate(downloadRoot) && !strings.HasSuffix(downloadRoot, "/") {
+			downloadRoot += "/"
+		}
+		newRepo.DownloadRoot = downloadRoot
+	}
+
+	var excluded []string
+	for _, name := range options.Exclude {
+		if absolutePath, absError := filepath.Abs(name); absError == nil {
+			excluded = append(excluded, absolutePath)
+		}
+	}
+
+	// collect the files first so they can be hashed in parallel
+	var entries []File
+	for _, directoryName := range directoryNames {
+		if _, statError := os.Stat(directoryName); os.IsNotExist(statError) {
+			fmt.Fprintln(out, statError)
+			continue
+		}
+		filepath.Walk(directoryName, func(currentPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintln(out, err)
+				return nil
+			}
+			if options.Ignore.Match(filepath.ToSlash(currentPath), info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if info.IsDir() {
+				return nil
+			}
+			if absolutePath, absError := filepath.Abs(currentPath); absError == nil && stringInSlice(absolutePath, excluded) {
+				return nil
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				link, linkError := readLink(filepath.ToSlash(currentPath))
+				if linkError != nil {
+					fmt.Fprintln(out, "Skipping", filepath.ToSlash(currentPath), ":", linkError)
+					return nil
+				}
+				entries = append(entries, File{Name: filepath.ToSlash(currentPath), Link: link})
+				return nil
+			}
+			entries = append(entries, File{
+				Name:    filepath.ToSlash(currentPath),
+				Size:    info.Size(),
+				ModTime: info.ModTime().Unix(),
+				Mode:    formatMode(info),
+			})
+			return nil
+		})
+	}
+
+	// workers fill in the hash of entries[i] so the order doesn't depend on
+	// which worker finishes first
+	newRepo.TextFiles = options.TextFiles
+	var toHash []int
+	reused := 0
+	for i, entry := range entries {
+		if len(entry.Link) > 0 {
+			continue
+		}
+		entries[i].NormalizeText = matchesAny(options.TextFiles, entry.Name)
+		if options.BlockThreshold > 0 && entry.Size >= options.BlockThreshold && !entries[i].NormalizeText {
+			entries[i].BlockSize = options.BlockSize
+		}
+		previousFile, found := previousFiles[entry.Name]
+		// nor are hashes of a file that is now hashed differently
+		found = found && matchesAny(previousTextFiles, entry.Name) == entries[i].NormalizeText
+		found = found && previousFile.BlockSize == entries[i].BlockSize
+		// how a file is served doesn't change with its content
+		entries[i].Compression = previousFile.Compression
+		entries[i].DownloadRoot = previousFile.DownloadRoot
+		entries[i].Optional = previousFile.Optional
+		if found && previousFile.Size == entry.Size && previousFile.ModTime == entry.ModTime && len(previousFile.Hash) > 0 {
+			entries[i].Hash = previousFile.Hash
+			entries[i].Blocks = previousFile.Blocks
+			entries[i].Patches = previousFile.Patches
+			reused++
+			continue
+		}
+		toHash = append(toHash, i)
+	}
+	if options.Previous != nil {
+		fmt.Fprintf(out, "Reusing %d hashes, hashing %d new or changed files\n", reused, len(toHash))
+	}
+
+	failed := make([]error, len(entries))
+	indexes := make(chan int)
+	var workers sync.WaitGroup
+	for i := 0; i < options.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range indexes {
+				currentFile, openError := os.Open(filepath.FromSlash(entries[i].Name))
+				if openError != nil {
+					failed[i] = openError
+					continue
+				}
+				entries[i].HashAlgo = options.HashAlgo
+				if blockSize := entries[i].BlockSize; blockSize > 0 {
+					entries[i].Hash, entries[i].Blocks, failed[i] = hashBlocks(currentFile, options.HashAlgo, blockSize)
+				} else {
+					entries[i].Hash, failed[i] = entries[i].calculateHash(currentFile)
+				}
+				currentFile.Close()
+			}
+		}()
+	}
+	for _, i := range toHash {
+		indexes <- i
+	}
+	close(indexes)
+	workers.Wait()
+
+	for i, entry := range entries {
+		if failed[i] != nil {
+			fmt.Fprintln(out, entry.Name, ":", failed[i])
+			continue
+		}
+		// the content is the same as in the previous manifest, the file
+		// changed when it did
+		entry.Changed = newRepo.Built
+		if previousFile, found := previousFiles[entry.Name]; found && previousFile.Hash == entry.Hash && previousFile.Link == entry.Link {
+			entry.Changed = previousBuilt
+			if previousFile.Changed > 0 {
+				entry.Changed = previousFile.Changed
+			}
+		}
+		newRepo.Files = append(newRepo.Files, entry)
+	}
+	sort.Slice(newRepo.Files, func(i, j int) bool {
+		return newRepo.Files[i].Name < newRepo.Files[j].Name
+	})
+	if len(options.PatchDir) > 0 {
+		for i := range newRepo.Files {
+			newRepo.Files[i].Patches = findPatches(options.PatchDir, newRepo.Files[i], out)
+		}
+	}
+	for _, entry := range newRepo.Files {
+		if len(entry.Link) > 0 {
+			fmt.Fprintln(out, entry.Name, "->", entry.Link)
+			continue
+		}
+		fmt.Fprintln(out, entry.Name, ":", entry.Hash)
+	}
+	return newRepo, nil
+}
+
+// findPatches lists the patches in patchDir that make rf. Patches that are
+// not smaller than the file are left out, downloading it is as fast.
+func findPatches(patchDir string, rf File, out io.Writer) []Patch {
+	if len(rf.Link) > 0 || rf.NormalizeText {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Join(filepath.FromSlash(patchDir), rf.Hash))
+	if err != nil {
+		return nil
+	}
+	var patches []Patch
+	for _, entry := range entries {
+		from := strings.TrimSuffix(entry.Name(), ".bsdiff")
+		if from == entry.Name() || !entry.Type().IsRegular() {
+			continue
+		}
+		name := path.Join(filepath.ToSlash(patchDir), rf.Hash, entry.Name())
+		if info, infoError := entry.Info(); infoError != nil || info.Size() >= rf.Size {
+			fmt.Fprintln(out, "Skipping patch", name, ": not smaller than", rf.Name)
+			continue
+		}
+		patches = append(patches, Patch{From: from, Name: name})
+	}
+	return patches
+}
@@ -0,0 +1,69 @@
+package updater
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chdirTemp runs the rest of the test in a new temporary directory, as the
+// updater works on the current directory. It returns the directory.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(previous) })
+	return dir
+}
+
+// writeFile creates name and the directories it is in
+func writeFile(t *testing.T, name string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCreateRepositoryConcurrency(t *testing.T) {
+	chdirTemp(t)
+	for i := 0; i < 50; i++ {
+		writeFile(t, filepath.Join("mod", fmt.Sprintf("dir%d", i%5), fmt.Sprintf("file%d.txt", i)), fmt.Sprint("content ", i))
+	}
+
+	var first []byte
+	for _, concurrency := range []int{1, 2, 8, 32} {
+		repo, err := CreateRepository([]string{"mod"}, CreateOptions{Concurrency: concurrency})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the build time is the only thing allowed to differ
+		repo.Built = 0
+		manifest, err := json.Marshal(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first == nil {
+			first = manifest
+			if len(repo.Files) != 50 {
+				t.Fatalf("manifest has %d files, want 50", len(repo.Files))
+			}
+		} else if string(manifest) != string(first) {
+			t.Errorf("manifest with %d workers differs from the one with 1:\n%s\n%s", concurrency, manifest, first)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+)
+
+// A repository with a Release and Deltas lets an updater that installed one
+// release fetch only what changed since, instead of the full manifest and a
+// check of every file. Deltas holds a manifest for each earlier release,
+// named after it like deltas/41.json, that lists the files added or changed
+// since that release and the files removed. When there is no delta for the
+// installed release the full manifest is used as before, so publishing
+// deltas is optional and only the releases worth it need one. Relative
+// addresses in a delta are relative to the full manifest, so they can be
+// copied from it as they are.
+
+// installedRelease is the release last installed in full from a
+// repository, see hashCache.Releases
+type installedRelease struct {
+	Release string
+	// the manifest it was installed from and its resolved Deltas. The
+	// relative addresses in a delta are relative to the manifest, not to
+	// the delta, so the same DownloadRoot works for both
+	ManifestURL string
+	Deltas      string
+}
+
+// NewDelta lists what changed from the files of previous to the files of
+// current as a delta manifest, to be saved in the Deltas directory under
+// the name of the previous release. Both need a Release.
+func NewDelta(previous *Repository, current *Repository) (*Repository, error) {
+	if len(previous.Release) == 0 || len(current.Release) == 0 {
+		return nil, errors.New("both repositories need a Release to make a delta")
+	}
+	if previous.Release == current.Release {
+		return nil, fmt.Errorf("both repositories are release %s", current.Release)
+	}
+	delta := *current
+	delta.Since = previous.Release
+	delta.Files = []File{}
+	delta.Removed = nil
+	// the delta is complete on its own, it doesn't pull anything in
+	delta.Include = nil
+
+	previousFiles := map[string]File{}
+	for _, rf := range previous.Files {
+		previousFiles[normalizeName(rf.Name)] = rf
+	}
+	currentNames := map[string]bool{}
+	for _, rf := range current.Files {
+		currentNames[normalizeName(rf.Name)] = true
+		previousFile, found := previousFiles[normalizeName(rf.Name)]
+		if !found || previousFile.Hash != rf.Hash || previousFile.Link != rf.Link || previousFile.Mode != rf.Mode {
+			delta.Files = append(delta.Files, rf)
+		}
+	}
+	for _, rf := range previous.Files {
+		if !currentNames[normalizeName(rf.Name)] {
+			delta.Removed = append(delta.Removed, rf.Name)
+		}
+	}
+	return &delta, nil
+}
+
+// fetchDelta returns the delta from the installed release to the current
+// one. It returns nil when there is no usable delta and the full manifest
+// has to be fetched instead, an error only when ctx was cancelled.
+func fetchDelta(ctx context.Context, options UpdateOptions, installed installedRelease) (*Repository, error) {
+	out := options.Output
+	deltaURL := installed.Deltas + url.PathEscape(installed.Release) + ".json"
+	deltaBytes, resolvedURL, fetchError := fetchVerified(ctx, options, nil, deltaURL)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if fetchError != nil {
+		fmt.Fprintln(out, "No changes since release", installed.Release, "are published, checking all the files")
+		options.Logger.Info("no delta for the installed release", "url", deltaURL, "error", fetchError)
+		return nil, nil
+	}
+	delta, _, parseError := parseRepository(deltaBytes, installed.ManifestURL, options)
+	if parseError == nil && (delta.Since != installed.Release || len(delta.Release) == 0) {
+		parseError = fmt.Errorf("it updates release %q instead of %q", delta.Since, installed.Release)
+	}
+	if parseError != nil {
+		fmt.Fprintln(out, "Not using the changes since release", installed.Release, ":", parseError)
+		options.Logger.Warn("unusable delta", "url", resolvedURL, "manifest", installed.ManifestURL, "error", parseError)
+		return nil, nil
+	}
+	for i := range delta.Removed {
+		delta.Removed[i] = normalizeName(delta.Removed[i])
+	}
+	if len(delta.Deltas) == 0 {
+		delta.Deltas = installed.Deltas
+	}
+	fmt.Fprintf(out, "Updating from release %s to %s: %d new or changed files, %d removed\n", installed.Release, delta.Release, len(delta.Files), len(delta.Removed))
+	return delta, nil
+}
+
+// removedFiles returns the files the delta removes that are still on disk
+func removedFiles(delta *Repository) []string {
+	kept := map[string]bool{}
+	for _, rf := range delta.Files {
+		kept[rf.Name] = true
+	}
+	var removed []string
+	for _, name := range delta.Removed {
+		if _, statError := os.Lstat(name); statError != nil || kept[name] || !(File{Name: name}).HasValidPath() {
+			continue
+		}
+		removed = append(removed, name)
+	}
+	return removed
+}
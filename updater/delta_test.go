@@ -0,0 +1,126 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewDelta(t *testing.T) {
+	previous := &Repository{Release: "1", Files: []File{
+		{Name: "a.txt", Hash: "1"},
+		{Name: "b.txt", Hash: "2"},
+		{Name: "c.txt", Hash: "3"},
+		{Name: "link", Link: "a.txt"},
+		{Name: "run.sh", Hash: "4"},
+	}}
+	current := &Repository{Release: "2", Include: []string{"other.json"}, Files: []File{
+		{Name: "a.txt", Hash: "1"},
+		{Name: "b.txt", Hash: "22"},
+		{Name: "d.txt", Hash: "5"},
+		{Name: "link", Link: "b.txt"},
+		{Name: "run.sh", Hash: "4", Mode: "0755"},
+	}}
+	delta, err := NewDelta(previous, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, rf := range delta.Files {
+		names = append(names, rf.Name)
+	}
+	if got := strings.Join(names, ","); got != "b.txt,d.txt,link,run.sh" {
+		t.Errorf("delta files %s, want b.txt,d.txt,link,run.sh", got)
+	}
+	if got := strings.Join(delta.Removed, ","); got != "c.txt" {
+		t.Errorf("delta removes %s, want c.txt", got)
+	}
+	if delta.Since != "1" || delta.Release != "2" || len(delta.Include) != 0 {
+		t.Errorf("delta is from %q to %q with Include %v", delta.Since, delta.Release, delta.Include)
+	}
+	if len(current.Files) != 5 {
+		t.Error("NewDelta changed the current repository")
+	}
+}
+
+func TestNewDeltaErrors(t *testing.T) {
+	for _, test := range []struct{ previous, current string }{
+		{"", "2"},
+		{"1", ""},
+		{"1", "1"},
+	} {
+		if _, err := NewDelta(&Repository{Release: test.previous}, &Repository{Release: test.current}); err == nil {
+			t.Errorf("delta from release %q to %q was made", test.previous, test.current)
+		}
+	}
+}
+
+func TestUpdateDelta(t *testing.T) {
+	dir := chdirTemp(t)
+	contents := map[string]string{"a.txt": "a", "b.txt": "b", "c.txt": "c"}
+	release := func(name string, files ...string) *Repository {
+		repo := &Repository{DownloadRoot: "files/", HashAlgo: DefaultHashAlgo, Release: name, Deltas: "deltas/"}
+		for _, file := range files {
+			hash, err := CalculateHash(strings.NewReader(contents[file]), DefaultHashAlgo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo.Files = append(repo.Files, File{Name: "mods/" + file, Hash: hash})
+		}
+		return repo
+	}
+	for name, content := range contents {
+		writeFile(t, filepath.Join("source", "files", "mods", name), content)
+	}
+	manifest := filepath.Join(dir, "source", "updater.json")
+	first := release("1", "a.txt", "b.txt", "c.txt")
+	if err := first.Save(manifest); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join("install", ".keep"), "")
+	if err := os.Chdir("install"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Update(context.Background(), UpdateOptions{RepoURL: manifest}); err != nil {
+		t.Fatal(err)
+	}
+
+	// release 2 changes b.txt and removes c.txt
+	contents["b.txt"] = "new b"
+	writeFile(t, filepath.Join(dir, "source", "files", "mods", "b.txt"), contents["b.txt"])
+	second := release("2", "a.txt", "b.txt")
+	if err := second.Save(manifest); err != nil {
+		t.Fatal(err)
+	}
+	delta, err := NewDelta(first, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "source", "deltas"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := delta.Save(filepath.Join(dir, "source", "deltas", "1.json")); err != nil {
+		t.Fatal(err)
+	}
+	var output bytes.Buffer
+	report, err := Update(context.Background(), UpdateOptions{RepoURL: manifest, Prune: true, Output: &output})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(output.String(), "Updating from release 1 to 2") {
+		t.Errorf("the delta was not used:\n%s", output.String())
+	}
+	if got, err := ioutil.ReadFile(filepath.Join("mods", "b.txt")); err != nil || string(got) != "new b" {
+		t.Errorf("mods/b.txt has %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join("mods", "c.txt")); err == nil || strings.Join(report.Pruned, ",") != "mods/c.txt" {
+		t.Errorf("mods/c.txt was not removed, pruned %v", report.Pruned)
+	}
+	if _, err := os.Stat(filepath.Join("mods", "a.txt")); err != nil {
+		t.Errorf("mods/a.txt is gone: %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix && !windows
+
+package updater
+
+// isDiskFull can't tell the errors apart here, a full disk fails every
+// download on its own
+func isDiskFull(err error) bool {
+	return false
+}
@@ -0,0 +1,14 @@
+//go:build unix
+
+package updater
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isDiskFull reports whether err means the volume or the user's quota ran
+// out of space
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
@@ -0,0 +1,20 @@
+//go:build windows
+
+package updater
+
+import (
+	"errors"
+	"syscall"
+)
+
+// not defined in the syscall package
+const (
+	errorHandleDiskFull syscall.Errno = 39
+	errorDiskFull       syscall.Errno = 112
+)
+
+// isDiskFull reports whether err means the volume or the user's quota ran
+// out of space
+func isDiskFull(err error) bool {
+	return errors.Is(err, errorDiskFull) || errors.Is(err, errorHandleDiskFull)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package updater
+
+import "errors"
+
+// freeSpace is not implemented here, the disk space check is skipped
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free disk space is not known on this platform")
+}
@@ -0,0 +1,25 @@
+//go:build windows
+
+package updater
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// freeSpace returns the bytes available to the current user on the volume
+// holding dir
+func freeSpace(dir string) (uint64, error) {
+	dirPointer, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var available uint64
+	result, _, callError := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(dirPointer)), uintptr(unsafe.Pointer(&available)), 0, 0)
+	if result == 0 {
+		return 0, callError
+	}
+	return available, nil
+}
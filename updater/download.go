@@ -0,0 +1,390 @@
+package updater
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// ErrDiskFull is matched by errors.Is when the downloads were stopped
+// because the disk ran out of space
+var ErrDiskFull = errors.New("disk full")
+
+// ErrTooManyErrors is matched by errors.Is when the downloads were stopped
+// after UpdateOptions.MaxErrors of them failed
+var ErrTooManyErrors = errors.New("too many failed downloads")
+
+// errChecksum is returned when a download doesn't match its hash
+var errChecksum = errors.New("Checksum failed")
+
+// downloader holds the state shared by the download workers
+type downloader struct {
+	// bytes written by all download attempts, updated atomically. kept as
+	// the first field so it is 64-bit aligned on 32-bit platforms
+	BytesWritten int64
+	// cancelling the context aborts all downloads
+	Context context.Context
+	// the manifest's own root followed by its mirrors
+	DownloadRoots []string
+	Options       UpdateOptions
+	Progress      *downloadProgress
+	Cache         *hashCache
+	// nil when the rate is not limited
+	Limiter *rateLimiter
+	// replaced files are saved here first, empty when not backing up
+	BackupDir string
+	// cancels Context for the downloads still running, see stopIfDiskFull
+	cancel   context.CancelFunc
+	diskFull int32
+}
+
+// stopIfDiskFull cancels the other downloads when err means the disk is
+// full, as every one of them would fail the same way
+func (d *downloader) stopIfDiskFull(err error) bool {
+	if !isDiskFull(err) {
+		return false
+	}
+	if atomic.CompareAndSwapInt32(&d.diskFull, 0, 1) {
+		d.Options.Logger.Error("disk full, stopping the downloads", "error", err)
+		d.cancel()
+	}
+	return true
+}
+
+// stoppedByDiskFull reports whether stopIfDiskFull cancelled the downloads
+func (d *downloader) stoppedByDiskFull() bool {
+	return atomic.LoadInt32(&d.diskFull) != 0
+}
+
+type downloadResult struct {
+	File File
+	Err  error
+}
+
+// downloadWithRetries calls downloadFile until it succeeds or the retries
+// run out, waiting exponentially longer between each attempt. The download
+// roots that served a copy failing its checksum are tried last, as a stale
+// mirror tends to serve the same copy again.
+func (d *downloader) downloadWithRetries(rf File) error {
+	badRoots := map[string]bool{}
+	err := d.downloadFromMirrors(rf, badRoots)
+	delay := retryBackoff
+	retries := d.Options.Retries
+	for attempt := 1; err != nil && attempt <= retries; attempt++ {
+		if d.Context.Err() != nil || d.stopIfDiskFull(err) {
+			return err
+		}
+		d.Progress.Println(fmt.Sprintf("Retrying %s in %v (attempt %d/%d) : %v", rf.Name, delay, attempt+1, retries+1, err))
+		d.Options.Logger.Warn("retrying download", "file", rf.Name, "attempt", attempt+1, "delay", delay, "error", err)
+		select {
+		case <-time.After(delay):
+		case <-d.Context.Done():
+			return d.Context.Err()
+		}
+		delay *= 2
+		err = d.downloadFromMirrors(rf, badRoots)
+	}
+	return err
+}
+
+// downloadFromMirrors tries the download roots in order and stops at the
+// first one that succeeds. A file with its own root only uses that. A file
+// with block hashes is repaired when possible rather than downloaded whole.
+// The roots in badRoots go after the others, and the ones whose copy fails
+// its checksum are added to it.
+func (d *downloader) downloadFromMirrors(rf File, badRoots map[string]bool) error {
+	downloadRoots := d.DownloadRoots
+	if len(rf.DownloadRoot) > 0 {
+		downloadRoots = []string{rf.DownloadRoot}
+	}
+	var goodRoots, staleRoots []string
+	for _, downloadRoot := range downloadRoots {
+		if badRoots[downloadRoot] {
+			staleRoots = append(staleRoots, downloadRoot)
+		} else {
+			goodRoots = append(goodRoots, downloadRoot)
+		}
+	}
+	var err error
+	tryPatches := rf.hasPatches()
+	for i, downloadRoot := range append(goodRoots, staleRoots...) {
+		if i > 0 {
+			d.Progress.Println(fmt.Sprintf("Downloading %s failed : %v, trying mirror %s", rf.Name, err, downloadRoot))
+			d.Options.Logger.Warn("trying mirror", "file", rf.Name, "mirror", downloadRoot, "error", err)
+		}
+		err = d.downloadFromRoot(downloadRoot, rf, &tryPatches)
+		if err == nil {
+			d.Options.Logger.Debug("downloaded from", "file", rf.Name, "root", downloadRoot, "staleRoots", len(staleRoots))
+			break
+		}
+		if errors.Is(err, errChecksum) {
+			badRoots[downloadRoot] = true
+		}
+		if d.Context.Err() != nil || isDiskFull(err) {
+			break
+		}
+	}
+	return err
+}
+
+// downloadFromRoot patches, repairs or downloads rf from downloadRoot.
+// tryPatches is turned off when no patch applies to the installed copy, as
+// the other roots can't change that.
+func (d *downloader) downloadFromRoot(downloadRoot string, rf File, tryPatches *bool) error {
+	if parentError := checkParent(rf.Name); parentError != nil {
+		return parentError
+	}
+	if *tryPatches {
+		err := d.patchFile(downloadRoot, rf)
+		if err == nil || d.Context.Err() != nil || isDiskFull(err) {
+			return err
+		}
+		*tryPatches = !errors.Is(err, errNoPatch)
+		d.Options.Logger.Debug("not patching, downloading the file", "file", rf.Name, "error", err)
+	}
+	if rf.hasBlocks() {
+		err := d.repairFile(downloadRoot, rf)
+		if err == nil || d.Context.Err() != nil || isDiskFull(err) {
+			return err
+		}
+		d.Options.Logger.Debug("not repairing, downloading the whole file", "file", rf.Name, "error", err)
+	}
+	return d.downloadFile(downloadRoot, rf)
+}
+
+// downloadFile fetches a single repository file and verifies its checksum.
+// It is safe to call from several goroutines at once.
+func (d *downloader) downloadFile(downloadRoot string, rf File) (err error) {
+	timeout := d.Options.Timeout
+
+	if makeDirError := makeParentDir(rf.Name); makeDirError != nil {
+		return makeDirError
+	}
+
+	// download next to the real file and only replace it once the checksum
+	// matches, so an interrupted download never leaves a broken file behind.
+	// a temp file left over from an earlier attempt is resumed if possible
+	tempName := rf.Name + ".tmp"
+	// resuming needs offsets into the file on the server, which don't match
+	// the decompressed temp file
+	compressed := len(rf.Compression) > 0
+	var offset int64
+	if !d.Options.NoResume && !compressed {
+		if info, statError := os.Stat(tempName); statError == nil && (rf.Size <= 0 || info.Size() < rf.Size) {
+			offset = info.Size()
+		}
+	}
+
+	// the request is cancelled when the body stalls for longer than the
+	// timeout, see timeoutReader
+	ctx, cancel := context.WithCancel(d.Context)
+	defer cancel()
+	stallTimer := time.AfterFunc(timeout, cancel)
+	defer stallTimer.Stop()
+
+	suffix, compressionError := compressedSuffix(rf.Compression)
+	if compressionError != nil {
+		return compressionError
+	}
+	fileAddress, templateError := downloadURL(downloadRoot, rf)
+	if templateError != nil {
+		return templateError
+	}
+	fullURL := fileAddress + suffix
+	request, requestError := d.Options.newRequest(ctx, fullURL)
+	if requestError != nil {
+		return requestError
+	}
+	if offset > 0 {
+		request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	d.Options.Logger.Debug("downloading", "url", fullURL, "offset", offset)
+	response, connectionError := d.Options.Client.Do(request)
+	if connectionError != nil {
+		return connectionError
+	}
+	defer response.Body.Close()
+	d.Options.Logger.Debug("download response", "url", fullURL, "status", response.StatusCode, "length", response.ContentLength)
+	if resolvedURL := response.Request.URL; resolvedURL.Host != request.URL.Host {
+		// usually a mirror or CDN, but also a sign of a stale DownloadRoot
+		d.Options.Logger.Debug("download redirected to another host", "url", fullURL, "resolved", resolvedURL.String())
+	}
+	if redirectError := checkRedirect(response); redirectError != nil {
+		return redirectError
+	}
+
+	openFlags := os.O_RDWR | os.O_CREATE
+	switch {
+	case offset > 0 && response.StatusCode == 206:
+		if !strings.HasPrefix(response.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			os.Remove(tempName)
+			return fmt.Errorf("unexpected Content-Range %q", response.Header.Get("Content-Range"))
+		}
+	case response.StatusCode == 200:
+		// server ignored the range or there was nothing to resume
+		offset = 0
+		openFlags |= os.O_TRUNC
+	default:
+		return fmt.Errorf("HTTP %d", response.StatusCode)
+	}
+
+	// a known size lets a truncated response fail before it is hashed. The
+	// size of a compressed response says nothing about the file
+	if !compressed && rf.Size > 0 && response.ContentLength >= 0 && offset+response.ContentLength != rf.Size {
+		return fmt.Errorf("server sent %d bytes, expected %d", offset+response.ContentLength, rf.Size)
+	}
+	if maxSize := d.Options.MaxFileSize; maxSize > 0 && offset+response.ContentLength > maxSize {
+		d.Options.Logger.Warn("file too large", "file", rf.Name, "size", offset+response.ContentLength, "limit", maxSize)
+		return fileTooLarge(offset+response.ContentLength, maxSize)
+	}
+	if !compressed && rf.Size <= 0 && response.ContentLength > 0 {
+		d.Progress.AddTotal(offset + response.ContentLength)
+	}
+
+	downloadTarget, openError := os.OpenFile(tempName, openFlags, defaultFileMode)
+	if openError != nil {
+		return openError
+	}
+	// a partial download is kept for resuming, anything else that failed is
+	// thrown away
+	keepTemp := false
+	defer func() {
+		if err != nil {
+			downloadTarget.Close()
+			// an interrupted run cleans up after itself
+			if !keepTemp || d.Options.NoResume || d.Context.Err() != nil {
+				os.Remove(tempName)
+			}
+		}
+	}()
+	downloadTarget.Seek(offset, os.SEEK_SET)
+	// the file is hashed as it is written, only the part resumed from
+	// needs to be read
+	hasher, hashError := rf.newHasher()
+	if hashError != nil {
+		return hashError
+	}
+	if offset > 0 {
+		if _, readError := io.Copy(hasher, io.NewSectionReader(downloadTarget, 0, offset)); readError != nil {
+			return readError
+		}
+	}
+
+	d.Progress.Add(offset)
+	var body io.Reader = &timeoutReader{reader: response.Body, timer: stallTimer, timeout: timeout}
+	if d.Limiter != nil {
+		body = &rateLimitedReader{reader: body, limiter: d.Limiter, ctx: ctx}
+	}
+	source, decompressError := decompress(rf.Compression, body)
+	if decompressError != nil {
+		return fmt.Errorf("unable to decompress : %v", decompressError)
+	}
+	if d.Options.MaxFileSize > 0 {
+		// a response without a length can't be checked up front, one more
+		// byte than allowed is enough to tell it is too large
+		source = io.LimitReader(source, d.Options.MaxFileSize-offset+1)
+	}
+	counter := &progressReader{reader: source, progress: d.Progress}
+	defer func() {
+		if err != nil {
+			d.Progress.Add(-offset - counter.count)
+		}
+	}()
+
+	reader := bufio.NewReader(counter)
+	written, writeError := reader.WriteTo(io.MultiWriter(downloadTarget, hasher))
+	atomic.AddInt64(&d.BytesWritten, written)
+	if writeError != nil {
+		// a partial file is only in the way when there is no space
+		keepTemp = !compressed && !isDiskFull(writeError)
+		if ctx.Err() != nil && d.Context.Err() == nil {
+			return fmt.Errorf("no data received for %v", timeout)
+		}
+		return writeError
+	}
+	if maxSize := d.Options.MaxFileSize; maxSize > 0 && offset+written > maxSize {
+		return fmt.Errorf("file is larger than the limit of %s", FormatBytes(maxSize))
+	}
+	if rf.Size > 0 && offset+written != rf.Size {
+		return fmt.Errorf("wrote %d bytes, expected %d", offset+written, rf.Size)
+	}
+
+	d.Options.Logger.Debug("downloaded", "file", rf.Name, "bytes", written, "total", offset+written)
+	return d.finishDownload(rf, tempName, downloadTarget, hasher)
+}
+
+// makeParentDir creates the directory rf.Name goes in. Workers may create
+// the same directory at once, so losing the race to another one is not an
+// error as long as a directory is there in the end. The directory has to
+// stay inside the current one, see checkParent.
+func makeParentDir(name string) error {
+	if parentError := checkParent(name); parentError != nil {
+		return parentError
+	}
+	dir := filepath.Dir(filepath.FromSlash(name))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		if info, statError := os.Stat(dir); statError != nil || !info.IsDir() {
+			return fmt.Errorf("unable to create directory for %s : %v", name, err)
+		}
+	}
+	return checkParent(name)
+}
+
+// finishDownload verifies the fully written temp file and moves it in place
+// of rf. hasher has seen everything written to the file, or is nil when the
+// file has to be read back to check it. downloadTarget is closed unless the
+// checksum fails; the caller removes the temp file on errors.
+func (d *downloader) finishDownload(rf File, tempName string, downloadTarget *os.File, hasher *fileHasher) error {
+	if hasher != nil {
+		if hash, hashError := hasher.Sum(); hashError != nil || hash != rf.Hash {
+			return errChecksum
+		}
+	} else {
+		// seek to beginning or the next CheckHash fails
+		downloadTarget.Seek(0, os.SEEK_SET)
+		if !rf.CheckHash(downloadTarget) {
+			return errChecksum
+		}
+	}
+
+	// windows refuses to rename files that are still open
+	if closeError := downloadTarget.Close(); closeError != nil {
+		return closeError
+	}
+	if ok, verifyError := d.Options.verify(tempName, rf); verifyError != nil {
+		return verifyError
+	} else if !ok {
+		return errRejected
+	}
+	if d.Options.PreserveTimes && rf.ModTime > 0 {
+		modTime := time.Unix(rf.ModTime, 0)
+		if timesError := os.Chtimes(tempName, modTime, modTime); timesError != nil {
+			return timesError
+		}
+	}
+	if modeError := applyMode(tempName, rf); modeError != nil {
+		return modeError
+	}
+	if len(d.BackupDir) > 0 {
+		if backupError := backupFile(d.BackupDir, rf.Name); backupError != nil {
+			return fmt.Errorf("unable to back up %s : %v", rf.Name, backupError)
+		}
+	}
+	if parentError := checkParent(rf.Name); parentError != nil {
+		return parentError
+	}
+	if renameError := os.Rename(tempName, rf.Name); renameError != nil {
+		return renameError
+	}
+	if info, statError := os.Stat(rf.Name); statError == nil {
+		d.Cache.Store(rf.Name, info, rf.cacheAlgo(), rf.Hash)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package updater
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// DefaultHashAlgo is used for manifests created before HashAlgo was added,
+// which are always sha1
+const DefaultHashAlgo = "sha1"
+
+// NewHash returns the hash for algo, which is one of sha1, sha256 or sha512
+func NewHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported hash algorithm %q", algo)
+}
+
+// CalculateHash reads r to the end and returns its hex encoded hash
+func CalculateHash(r io.Reader, algo string) (string, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+
+	calculated := h.Sum(nil)
+	return hex.EncodeToString(calculated), nil
+}
+
+// CalculateTextHash is CalculateHash of r with a leading UTF-8 byte order
+// mark removed and CRLF line endings turned into LF, so that a text file
+// hashes the same whichever platform it was saved on
+func CalculateTextHash(r io.Reader, algo string) (string, error) {
+	h, err := NewHash(algo)
+	if err != nil {
+		return "", err
+	}
+	normalizer := &textNormalizer{w: h}
+	if _, err := io.Copy(normalizer, r); err != nil {
+		return "", err
+	}
+	if err := normalizer.Close(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileHasher hashes what is written to it the same way File.calculateHash
+// reads it, so that a download can be checked as it is written instead of
+// being read back afterwards
+type fileHasher struct {
+	hash hash.Hash
+	// nil unless the file is hashed as text
+	normalizer *textNormalizer
+}
+
+func (f File) newHasher() (*fileHasher, error) {
+	h, err := NewHash(f.HashAlgo)
+	if err != nil {
+		return nil, err
+	}
+	hasher := &fileHasher{hash: h}
+	if f.NormalizeText {
+		hasher.normalizer = &textNormalizer{w: h}
+	}
+	return hasher, nil
+}
+
+func (h *fileHasher) Write(p []byte) (int, error) {
+	if h.normalizer != nil {
+		return h.normalizer.Write(p)
+	}
+	return h.hash.Write(p)
+}
+
+// Sum returns the hex encoded hash of everything written so far. Nothing
+// can be written after it.
+func (h *fileHasher) Sum() (string, error) {
+	if h.normalizer != nil {
+		if err := h.normalizer.Close(); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.hash.Sum(nil)), nil
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// textNormalizer writes what it is given to w without the byte order mark
+// and carriage returns before line feeds. Close writes out what is held
+// back at the end.
+type textNormalizer struct {
+	w io.Writer
+	// the first bytes, held until it is known whether they are a BOM
+	head     []byte
+	headDone bool
+	// a carriage return that may or may not be followed by a line feed
+	pendingCR bool
+}
+
+func (t *textNormalizer) Write(p []byte) (int, error) {
+	n := len(p)
+	if !t.headDone {
+		t.head = append(t.head, p...)
+		if len(t.head) < len(utf8BOM) && bytes.HasPrefix(utf8BOM, t.head) {
+			return n, nil
+		}
+		p = bytes.TrimPrefix(t.head, utf8BOM)
+		t.head = nil
+		t.headDone = true
+	}
+	normalized := make([]byte, 0, len(p)+1)
+	for _, c := range p {
+		if t.pendingCR {
+			t.pendingCR = false
+			if c != '\n' {
+				normalized = append(normalized, '\r')
+			}
+		}
+		if c == '\r' {
+			t.pendingCR = true
+			continue
+		}
+		normalized = append(normalized, c)
+	}
+	_, err := t.w.Write(normalized)
+	return n, err
+}
+
+func (t *textNormalizer) Close() error {
+	var rest []byte
+	if !t.headDone {
+		rest = bytes.TrimPrefix(t.head, utf8BOM)
+		t.headDone = true
+	}
+	if t.pendingCR {
+		rest = append(rest, '\r')
+		t.pendingCR = false
+	}
+	_, err := t.w.Write(rest)
+	return err
+}
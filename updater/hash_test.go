@@ -0,0 +1,45 @@
+package updater
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCalculateHashMatchesSha1sum(t *testing.T) {
+	sha1sum, err := exec.LookPath("sha1sum")
+	if err != nil {
+		t.Skip("sha1sum not found")
+	}
+	// one byte past the old 1 MB read buffer
+	data := make([]byte, 1<<20+1)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	name := filepath.Join(t.TempDir(), "file")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := exec.Command(sha1sum, name).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Fields(string(output))[0]
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := CalculateHash(f, "sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("CalculateHash = %s, sha1sum = %s", got, want)
+	}
+}
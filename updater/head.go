@@ -0,0 +1,139 @@
+package updater
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// With UpdateOptions.HeadCheck every file is first asked about with a HEAD
+// request, so files the server doesn't have fail before anything is
+// downloaded, and files the manifest has no size for get one for the disk
+// space check and the progress. Servers that don't support HEAD answer 405,
+// the check is then given up and the files are downloaded as usual.
+
+// errHeadUnsupported means the server refused the HEAD request itself
+var errHeadUnsupported = errors.New("the server doesn't support HEAD requests")
+
+// headCheck returns files with the sizes the server reported filled in, and
+// the files no download root can serve. A root that fails for any other
+// reason than not having the file is left for the download to retry.
+func headCheck(ctx context.Context, options UpdateOptions, downloadRoots []string, files []File) ([]File, []FileError) {
+	checked := make([]File, len(files))
+	failed := make([]error, len(files))
+	var unsupported int32
+	indexes := make(chan int)
+	var workers sync.WaitGroup
+	for i := 0; i < options.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i := range indexes {
+				checked[i] = files[i]
+				if atomic.LoadInt32(&unsupported) != 0 || ctx.Err() != nil {
+					continue
+				}
+				roots := downloadRoots
+				if len(files[i].DownloadRoot) > 0 {
+					roots = []string{files[i].DownloadRoot}
+				}
+				var err error
+				checked[i], err = headFile(ctx, options, roots, files[i])
+				if errors.Is(err, errHeadUnsupported) {
+					if atomic.CompareAndSwapInt32(&unsupported, 0, 1) {
+						fmt.Fprintln(options.Output, "Not checking the files first :", err)
+						options.Logger.Warn("HEAD not supported", "file", files[i].Name)
+					}
+					continue
+				}
+				failed[i] = err
+			}
+		}()
+	}
+	for i := range files {
+		indexes <- i
+	}
+	close(indexes)
+	workers.Wait()
+
+	var available []File
+	var missing []FileError
+	for i, rf := range checked {
+		if failed[i] != nil {
+			fmt.Fprintln(options.Output, "Skipping", rf.Name, ":", failed[i])
+			options.Logger.Warn("file not on the server", "file", rf.Name, "error", failed[i])
+			missing = append(missing, FileError{rf.Name, failed[i].Error()})
+			continue
+		}
+		available = append(available, rf)
+	}
+	return available, missing
+}
+
+// headFile asks the roots in order about rf until one of them has it. It
+// fails only when every root answered that it doesn't have the file or has
+// one of another size.
+func headFile(ctx context.Context, options UpdateOptions, downloadRoots []string, rf File) (File, error) {
+	suffix, err := compressedSuffix(rf.Compression)
+	if err != nil {
+		return rf, nil
+	}
+	// the size of a compressed file says nothing about the file itself
+	compressed := len(rf.Compression) > 0
+	var lastError error
+	for _, downloadRoot := range downloadRoots {
+		fileAddress, templateError := downloadURL(downloadRoot, rf)
+		if templateError != nil {
+			return rf, nil
+		}
+		requestCtx, cancel := context.WithTimeout(ctx, options.Timeout)
+		response, requestError := headRequest(requestCtx, options, fileAddress+suffix)
+		cancel()
+		if requestError != nil {
+			// the download tries again, and the other roots
+			options.Logger.Debug("HEAD failed", "url", fileAddress+suffix, "error", requestError)
+			return rf, nil
+		}
+		options.Logger.Debug("HEAD response", "url", fileAddress+suffix, "status", response.StatusCode, "length", response.ContentLength, "etag", response.Header.Get("ETag"))
+		switch {
+		case response.StatusCode == http.StatusMethodNotAllowed || response.StatusCode == http.StatusNotImplemented:
+			return rf, errHeadUnsupported
+		case response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone:
+			lastError = fmt.Errorf("not found on the server (HTTP %d)", response.StatusCode)
+			continue
+		case response.StatusCode != http.StatusOK:
+			return rf, nil
+		}
+		if compressed || response.ContentLength < 0 {
+			return rf, nil
+		}
+		if rf.Size > 0 && response.ContentLength != rf.Size {
+			lastError = fmt.Errorf("the server has %d bytes, expected %d", response.ContentLength, rf.Size)
+			continue
+		}
+		rf.Size = response.ContentLength
+		return rf, nil
+	}
+	return rf, lastError
+}
+
+// headRequest sends a HEAD request with the headers of a download
+func headRequest(ctx context.Context, options UpdateOptions, address string) (*http.Response, error) {
+	request, err := options.newRequest(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	request.Method = http.MethodHead
+	response, err := options.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	if redirectError := checkRedirect(response); redirectError != nil {
+		return nil, redirectError
+	}
+	return response, nil
+}
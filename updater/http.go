@@ -0,0 +1,184 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// idleConnsPerHost is the least number of idle connections kept open to a
+// host, more with a higher UpdateOptions.Concurrency
+const idleConnsPerHost = 4
+
+// NewHTTPClient returns a client that gives up on connecting, the TLS
+// handshake and waiting for response headers after timeout. Reading the body
+// is not limited by the client because large files take a long time; see
+// timeoutReader for that. file:// URLs are read from the local disk.
+// The proxy comes from HTTP_PROXY, HTTPS_PROXY and NO_PROXY.
+func NewHTTPClient(timeout time.Duration) *http.Client {
+	return newHTTPClient(UpdateOptions{Timeout: timeout})
+}
+
+// newHTTPClient is NewHTTPClient with the network settings of options:
+// Proxy, ForceIPv4, DNSServer and PinSHA256, keeping a connection open for
+// each of the Concurrency workers. None of them change anything
+// outside of the updater's own requests.
+func newHTTPClient(options UpdateOptions) *http.Client {
+	timeout, forceIPv4, dnsServer := options.Timeout, options.ForceIPv4, options.DNSServer
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if len(dnsServer) > 0 {
+		dnsDialer := &net.Dialer{Timeout: timeout}
+		dialer.Resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				return dnsDialer.DialContext(ctx, network, dnsServer)
+			},
+		}
+	}
+	dialContext := dialer.DialContext
+	if forceIPv4 {
+		dialContext = func(ctx context.Context, network string, address string) (net.Conn, error) {
+			if network == "tcp" {
+				network = "tcp4"
+			}
+			return dialer.DialContext(ctx, network, address)
+		}
+	}
+	proxy := http.ProxyFromEnvironment
+	if len(options.Proxy) > 0 {
+		// an invalid proxy fails every request rather than being ignored
+		proxyURL, proxyError := ParseProxy(options.Proxy)
+		proxy = func(*http.Request) (*url.URL, error) {
+			return proxyURL, proxyError
+		}
+	}
+	// the manifest and every file come through this one client, mostly from
+	// the same host. Each worker keeps its connection between files instead
+	// of the default of two idle ones, which would make the rest connect and
+	// shake hands again for every small file
+	idlePerHost := max(options.Concurrency, idleConnsPerHost)
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          4 * idlePerHost,
+		MaxIdleConnsPerHost:   idlePerHost,
+		IdleConnTimeout:       90 * time.Second,
+		// a custom dialer and TLS config turn HTTP/2 off otherwise
+		ForceAttemptHTTP2: true,
+	}
+	if len(options.PinSHA256) > 0 {
+		transport.TLSClientConfig = &tls.Config{VerifyConnection: pinnedKeys(options.PinSHA256)}
+	}
+	transport.RegisterProtocol("file", http.NewFileTransport(localFileSystem{}))
+	return &http.Client{Transport: transport}
+}
+
+// ParsePin reads the SHA-256 hash of a certificate public key, either as
+// hex with optional colons or in the base64 "sha256/..." form used by HPKP
+// and curl's --pinnedpubkey
+func ParsePin(pin string) ([]byte, error) {
+	var hash []byte
+	var err error
+	if encoded := strings.TrimPrefix(pin, "sha256/"); encoded != pin || strings.HasSuffix(pin, "=") {
+		hash, err = base64.StdEncoding.DecodeString(encoded)
+	} else {
+		hash, err = hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	}
+	if err != nil || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("invalid pin %q, expected the SHA-256 of a public key in hex or as sha256/base64", pin)
+	}
+	return hash, nil
+}
+
+// pinnedKeys accepts a TLS connection only if the public key of the
+// server's certificate hashes to one of pins. This comes on top of the
+// usual certificate checks.
+func pinnedKeys(pins [][]byte) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return errors.New("server sent no certificate to check against the pinned keys")
+		}
+		sum := sha256.Sum256(state.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(sum[:], pin) {
+				return nil
+			}
+		}
+		return fmt.Errorf("server certificate doesn't match the pinned keys, its key is sha256/%s", base64.StdEncoding.EncodeToString(sum[:]))
+	}
+}
+
+// ParseProxy reads a proxy address such as http://host:port or
+// socks5://host:port. An address without a scheme is an HTTP proxy.
+func ParseProxy(address string) (*url.URL, error) {
+	proxyURL, err := url.Parse(address)
+	if err != nil || len(proxyURL.Host) == 0 {
+		// host:port alone parses as a scheme and an opaque path
+		proxyURL, err = url.Parse("http://" + address)
+	}
+	if err != nil || len(proxyURL.Host) == 0 {
+		return nil, fmt.Errorf("invalid proxy %q", address)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return proxyURL, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy %q, expected http, https or socks5", address)
+}
+
+// DNSServerAddress adds the default DNS port to a server given without one,
+// such as "1.1.1.1" or "2606:4700:4700::1111"
+func DNSServerAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "53")
+}
+
+// noRedirects stops the client at the first redirect when
+// UpdateOptions.NoRedirect is set, see checkRedirect
+func noRedirects(request *http.Request, via []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// checkRedirect explains a redirect response that was not followed
+func checkRedirect(response *http.Response) error {
+	if response.StatusCode < 300 || response.StatusCode >= 400 {
+		return nil
+	}
+	location := response.Header.Get("Location")
+	if len(location) == 0 {
+		return nil
+	}
+	return fmt.Errorf("HTTP %d redirect to %s, following redirects is disabled", response.StatusCode, location)
+}
+
+// timeoutReader resets timer on every read. The timer is set up to cancel
+// the request, so a body that stalls for longer than timeout gets aborted.
+type timeoutReader struct {
+	reader  io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (r *timeoutReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	r.timer.Reset(r.timeout)
+	return n, err
+}
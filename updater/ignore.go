@@ -0,0 +1,146 @@
+package updater
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// IgnoreFileName lists the files left out of a new repository, one
+// gitignore style pattern per line
+const IgnoreFileName = ".updaterignore"
+
+type ignorePattern struct {
+	segments []string
+	// re-includes files matched by an earlier pattern
+	negate bool
+	// only matches directories
+	dirOnly bool
+	// a pattern containing a slash is matched against the whole path,
+	// otherwise against the name of any file or directory
+	anchored bool
+}
+
+// IgnoreRules are the patterns of an .updaterignore file. As with
+// gitignore, the last matching pattern decides and a "!" in front of a
+// pattern includes the files again. "**" matches any number of directories.
+type IgnoreRules struct {
+	patterns []ignorePattern
+}
+
+// LoadIgnoreFile reads the rules from name. A missing file ignores nothing.
+func LoadIgnoreFile(name string) (*IgnoreRules, error) {
+	ignoreFile, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return &IgnoreRules{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer ignoreFile.Close()
+	return ParseIgnoreRules(ignoreFile)
+}
+
+// ParseIgnoreRules reads gitignore style patterns from r. Empty lines and
+// lines starting with # are skipped.
+func ParseIgnoreRules(r io.Reader) (*IgnoreRules, error) {
+	rules := &IgnoreRules{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var pattern ignorePattern
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		pattern.anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if len(line) == 0 {
+			continue
+		}
+		pattern.segments = strings.Split(line, "/")
+		rules.patterns = append(rules.patterns, pattern)
+	}
+	return rules, scanner.Err()
+}
+
+// Match reports whether the slash separated path name is ignored
+func (r *IgnoreRules) Match(name string, isDir bool) bool {
+	if r == nil {
+		return false
+	}
+	name = path.Clean(name)
+	segments := strings.Split(name, "/")
+	ignored := false
+	for _, pattern := range r.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		var matched bool
+		if pattern.anchored {
+			matched = matchSegments(pattern.segments, segments)
+		} else {
+			matched = matchSegments(pattern.segments, segments[len(segments)-1:])
+		}
+		if matched {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	matched, _ := path.Match(pattern[0], segments[0])
+	return matched && matchSegments(pattern[1:], segments[1:])
+}
+
+// MatchGlob reports whether the slash separated path name or one of its
+// parent directories matches pattern. Like in IgnoreRules, a pattern without
+// a slash matches a name at any depth and "**" matches any number of
+// directories.
+func MatchGlob(pattern string, name string) bool {
+	anchored := strings.Contains(strings.TrimRight(pattern, "/"), "/")
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	segments := strings.Split(path.Clean(name), "/")
+	for i := 1; i <= len(segments); i++ {
+		if anchored && matchSegments(patternSegments, segments[:i]) {
+			return true
+		}
+		if !anchored && matchSegments(patternSegments, segments[i-1:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether name matches one of the MatchGlob patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if MatchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package updater
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	rules, err := ParseIgnoreRules(strings.NewReader(`
+# comments and empty lines are skipped
+
+*.bak
+/build
+logs/
+docs/**/draft*
+!keep.bak
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}{
+		{"a.bak", false, true},
+		{"mods/addons/a.bak", false, true},
+		{"keep.bak", false, false},
+		{"mods/keep.bak", false, false},
+		{"a.pbo", false, false},
+		{"build", true, true},
+		{"build", false, true},
+		{"mods/build", true, false},
+		{"logs", true, true},
+		{"mods/logs", true, true},
+		{"logs", false, false},
+		{"docs/draft.txt", false, true},
+		{"docs/a/b/draft.txt", false, true},
+		{"docs/a/final.txt", false, false},
+		{"other/docs/draft.txt", false, false},
+	} {
+		if got := rules.Match(test.name, test.isDir); got != test.ignored {
+			t.Errorf("Match(%q, %v) = %v, want %v", test.name, test.isDir, got, test.ignored)
+		}
+	}
+}
+
+func TestIgnoreRulesNil(t *testing.T) {
+	var rules *IgnoreRules
+	if rules.Match("a.txt", false) {
+		t.Error("nil rules ignore files")
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		name    string
+		matched bool
+	}{
+		{"*.pbo", "a.pbo", true},
+		{"*.pbo", "mods/addons/a.pbo", true},
+		{"*.pbo", "a.pbo.bisign", false},
+		{"addons", "mods/addons/a.pbo", true},
+		{"mods/addons", "mods/addons/a.pbo", true},
+		{"mods/addons/", "mods/addons/a.pbo", true},
+		{"/mods", "mods/a.pbo", true},
+		{"mods/addons", "other/mods/addons/a.pbo", false},
+		{"@*/addons/*.pbo", "@ace/addons/a.pbo", true},
+		{"@*/addons/*.pbo", "@ace/optionals/a.pbo", false},
+		{"**/keys", "@ace/keys/ace.bikey", true},
+		{"mods/**/a.pbo", "mods/a.pbo", true},
+		{"mods/**/a.pbo", "mods/x/y/a.pbo", true},
+		{"mods/**/a.pbo", "other/x/a.pbo", false},
+		{"a?c.txt", "abc.txt", true},
+		{"a[0-9].txt", "ab.txt", false},
+	} {
+		if got := MatchGlob(test.pattern, test.name); got != test.matched {
+			t.Errorf("MatchGlob(%q, %q) = %v, want %v", test.pattern, test.name, got, test.matched)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package updater
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// localFileSystem serves file:// URLs from the local disk, see
+// NewHTTPClient. Going through http.FileServer keeps ranges and status codes
+// working the same way as with a real server, so resuming and error handling
+// need no special cases.
+type localFileSystem struct{}
+
+func (localFileSystem) Open(name string) (http.File, error) {
+	if runtime.GOOS == "windows" {
+		// file:///C:/repo arrives as /C:/repo
+		name = strings.TrimPrefix(name, "/")
+	}
+	return os.Open(filepath.FromSlash(name))
+}
+
+// isLocalPath reports whether address is a path on disk instead of a URL
+func isLocalPath(address string) bool {
+	if filepath.IsAbs(address) || filepath.VolumeName(address) != "" {
+		return true
+	}
+	parsedURL, err := url.Parse(address)
+	return err != nil || len(parsedURL.Scheme) == 0
+}
+
+// fileURL turns a local path into a file:// URL. A directory gets a trailing
+// slash so that names can be appended to it.
+func fileURL(name string) (string, error) {
+	absolutePath, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	slashPath := filepath.ToSlash(absolutePath)
+	if !strings.HasPrefix(slashPath, "/") {
+		slashPath = "/" + slashPath
+	}
+	if info, statError := os.Stat(absolutePath); statError == nil && info.IsDir() && !strings.HasSuffix(slashPath, "/") {
+		slashPath += "/"
+	}
+	return (&url.URL{Scheme: "file", Path: slashPath}).String(), nil
+}
+
+// resolveDownloadRoot makes a download root usable for fetching. Local
+// directories become file:// URLs and relative roots are taken relative to
+// the manifest, so a repository copied to a USB stick works wherever it is
+// mounted. The placeholders of a template are left as they are.
+func resolveDownloadRoot(manifestURL string, downloadRoot string) (string, error) {
+	if len(downloadRoot) == 0 {
+		return downloadRoot, nil
+	}
+	if i := strings.Index(downloadRoot, "{"); i >= 0 && isTemplate(downloadRoot) {
+		// only the part before them is a path or URL, they would be escaped
+		prefix := downloadRoot[:i]
+		if len(prefix) == 0 {
+			prefix = "./"
+		}
+		resolved, err := resolveDownloadRoot(manifestURL, prefix)
+		return resolved + downloadRoot[i:], err
+	}
+	if filepath.IsAbs(downloadRoot) || filepath.VolumeName(downloadRoot) != "" {
+		return fileURL(downloadRoot)
+	}
+	rootURL, err := url.Parse(downloadRoot)
+	if err != nil || rootURL.IsAbs() {
+		return downloadRoot, nil
+	}
+	baseURL, err := url.Parse(manifestURL)
+	if err != nil {
+		return downloadRoot, nil
+	}
+	return baseURL.ResolveReference(rootURL).String(), nil
+}
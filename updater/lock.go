@@ -0,0 +1,24 @@
+package updater
+
+import (
+	"errors"
+	"fmt"
+)
+
+// LockFileName is locked while Update runs so that two updaters started in
+// the same directory don't download over each other
+const LockFileName = ".updater.lock"
+
+// ErrLocked is returned by Lock when another updater holds the lock
+var ErrLocked = errors.New("another updater is already running in this directory")
+
+// Lock takes the lock file name, failing with ErrLocked if it is already
+// taken. The lock is released by calling unlock or when the process exits,
+// however it exits.
+func Lock(name string) (unlock func() error, err error) {
+	unlock, err = lockFile(name)
+	if err == ErrLocked {
+		return nil, fmt.Errorf("%w (%s is locked)", ErrLocked, name)
+	}
+	return unlock, err
+}
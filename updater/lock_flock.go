@@ -0,0 +1,27 @@
+//go:build linux || darwin || freebsd || openbsd || netbsd || dragonfly
+
+package updater
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+func lockFile(name string) (func() error, error) {
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrLocked
+		}
+		return nil, err
+	}
+	// only for people wondering who holds the lock
+	file.Truncate(0)
+	fmt.Fprintln(file, os.Getpid())
+	return file.Close, nil
+}
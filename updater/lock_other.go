@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly && !windows
+
+package updater
+
+import "os"
+
+// without file locks the lock is the existence of the file. It stays behind
+// if the updater is killed and has to be removed by hand.
+func lockFile(name string) (func() error, error) {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, err
+	}
+	file.Close()
+	return func() error { return os.Remove(name) }, nil
+}
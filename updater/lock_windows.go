@@ -0,0 +1,23 @@
+//go:build windows
+
+package updater
+
+import "syscall"
+
+const errorSharingViolation syscall.Errno = 32
+
+// opening the file without sharing keeps everyone else from opening it
+// until the handle is closed
+func lockFile(name string) (func() error, error) {
+	namePointer, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(namePointer, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, err
+	}
+	return func() error { return syscall.CloseHandle(handle) }, nil
+}
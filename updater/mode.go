@@ -0,0 +1,50 @@
+package updater
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// defaultFileMode is what downloads are created with, a File without a Mode
+// gets it
+const defaultFileMode os.FileMode = 0644
+
+// parseMode reads a File Mode such as "0755"
+func parseMode(mode string) (os.FileMode, error) {
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || bits&^0777 != 0 {
+		return 0, fmt.Errorf("invalid mode %q, expected octal permissions such as 0755", mode)
+	}
+	return os.FileMode(bits), nil
+}
+
+// formatMode is the File Mode of a file with the permissions of info, empty
+// for the default
+func formatMode(info os.FileInfo) string {
+	perm := info.Mode().Perm()
+	if !modesSupported || perm == defaultFileMode {
+		return ""
+	}
+	return fmt.Sprintf("%04o", uint32(perm))
+}
+
+// applyMode sets the permissions of name to the Mode of rf, if it has one
+// and they differ
+func applyMode(name string, rf File) error {
+	if !modesSupported || len(rf.Mode) == 0 {
+		return nil
+	}
+	mode, err := parseMode(rf.Mode)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm() == mode {
+		return nil
+	}
+	return os.Chmod(name, mode)
+}
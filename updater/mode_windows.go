@@ -0,0 +1,7 @@
+//go:build windows
+
+package updater
+
+// windows only has a read-only attribute, which says nothing about whether
+// a file is meant to be run, so modes are neither recorded nor applied
+const modesSupported = false
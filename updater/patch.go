@@ -0,0 +1,254 @@
+package updater
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// A file that changed a little since an earlier release can list patches
+// made from the earlier copies with bsdiff. When the installed copy matches
+// the base of one of them, only the patch is downloaded and applied with
+// bspatch, and the result is checked against the hash in the manifest like
+// any download. Otherwise, or when the patch doesn't work out, the whole file
+// is downloaded.
+
+// Patch turns the copy of a file with the hash From into the one listed in
+// the manifest
+type Patch struct {
+	// hash of the earlier copy, with the algorithm of the manifest
+	From string
+	// relative to DownloadRoot and the mirrors, in the format of bsdiff 4
+	Name string
+}
+
+// patchMagic starts a patch made by bsdiff
+const patchMagic = "BSDIFF40"
+
+// errNoPatch means none of the patches apply to the installed copy, which
+// is the same whichever mirror is tried
+var errNoPatch = errors.New("no patch applies to the installed copy")
+
+// hasPatches reports whether the file can be patched. Text files may have
+// other line endings than the copy the patch was made from.
+func (f File) hasPatches() bool {
+	return len(f.Patches) > 0 && f.Size > 0 && !f.NormalizeText
+}
+
+// patchFile writes rf to its temp file by patching the installed copy with
+// a patch from downloadRoot. It fails when no patch applies, and the caller
+// downloads the file instead.
+func (d *downloader) patchFile(downloadRoot string, rf File) (err error) {
+	tempName := rf.Name + ".tmp"
+	// a partial download is closer to done than a patch
+	if _, statError := os.Stat(tempName); statError == nil && !d.Options.NoResume {
+		return errors.New("resuming the partial download instead")
+	}
+	if isTemplate(downloadRoot) {
+		return errors.New("a templated download root has no place for patches")
+	}
+	existing, openError := os.Open(filepath.FromSlash(rf.Name))
+	if openError != nil {
+		return fmt.Errorf("%w : %v", errNoPatch, openError)
+	}
+	defer existing.Close()
+	info, statError := existing.Stat()
+	if statError != nil {
+		return statError
+	}
+	installedHash, found := d.Cache.Lookup(rf.Name, info, rf.HashAlgo)
+	if !found {
+		if installedHash, err = CalculateHash(existing, rf.HashAlgo); err != nil {
+			return err
+		}
+		d.Cache.Store(rf.Name, info, rf.HashAlgo, installedHash)
+	}
+	var patch *Patch
+	for i := range rf.Patches {
+		if rf.Patches[i].From == installedHash {
+			patch = &rf.Patches[i]
+			break
+		}
+	}
+	if patch == nil {
+		return errNoPatch
+	}
+
+	// a patch as large as the file saves nothing
+	patchBytes, fetchError := d.fetchPatch(downloadRoot+patch.Name, rf.Size)
+	if fetchError != nil {
+		return fetchError
+	}
+	atomic.AddInt64(&d.BytesWritten, int64(len(patchBytes)))
+
+	downloadTarget, openError := os.OpenFile(tempName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, defaultFileMode)
+	if openError != nil {
+		return openError
+	}
+	var written int64
+	defer func() {
+		if err != nil {
+			downloadTarget.Close()
+			os.Remove(tempName)
+			d.Progress.Add(-written)
+		}
+	}()
+	hasher, hashError := rf.newHasher()
+	if hashError != nil {
+		return hashError
+	}
+	written, err = applyPatch(existing, info.Size(), patchBytes, io.MultiWriter(downloadTarget, hasher))
+	d.Progress.Add(written)
+	if err != nil {
+		return err
+	}
+	if written != rf.Size {
+		return fmt.Errorf("patch made %d bytes, expected %d", written, rf.Size)
+	}
+	if err = d.finishDownload(rf, tempName, downloadTarget, hasher); err != nil {
+		return err
+	}
+	d.Progress.Println(fmt.Sprintf("Patched %s, downloaded %s instead of %s", rf.Name, FormatBytes(int64(len(patchBytes))), FormatBytes(rf.Size)))
+	d.Options.Logger.Debug("patched", "file", rf.Name, "patch", patch.Name, "bytes", len(patchBytes))
+	return nil
+}
+
+// fetchPatch downloads the patch at fullURL, failing if it is not smaller
+// than limit bytes
+func (d *downloader) fetchPatch(fullURL string, limit int64) ([]byte, error) {
+	timeout := d.Options.Timeout
+	// the request is cancelled when the body stalls, see timeoutReader
+	ctx, cancel := context.WithCancel(d.Context)
+	defer cancel()
+	stallTimer := time.AfterFunc(timeout, cancel)
+	defer stallTimer.Stop()
+
+	request, requestError := d.Options.newRequest(ctx, fullURL)
+	if requestError != nil {
+		return nil, requestError
+	}
+	d.Options.Logger.Debug("downloading patch", "url", fullURL)
+	response, connectionError := d.Options.Client.Do(request)
+	if connectionError != nil {
+		return nil, connectionError
+	}
+	defer response.Body.Close()
+	if redirectError := checkRedirect(response); redirectError != nil {
+		return nil, redirectError
+	}
+	if response.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP %d", response.StatusCode)
+	}
+	if response.ContentLength >= limit {
+		return nil, fmt.Errorf("patch of %s is not smaller than the file", FormatBytes(response.ContentLength))
+	}
+
+	var body io.Reader = &timeoutReader{reader: response.Body, timer: stallTimer, timeout: timeout}
+	if d.Limiter != nil {
+		body = &rateLimitedReader{reader: body, limiter: d.Limiter, ctx: ctx}
+	}
+	patchBytes, readError := io.ReadAll(io.LimitReader(body, limit))
+	if readError != nil {
+		if ctx.Err() != nil && d.Context.Err() == nil {
+			return nil, fmt.Errorf("no data received for %v", timeout)
+		}
+		return nil, readError
+	}
+	if int64(len(patchBytes)) >= limit {
+		return nil, errors.New("patch is not smaller than the file")
+	}
+	return patchBytes, nil
+}
+
+// applyPatch writes the result of the bsdiff patch applied to old, which is
+// oldSize bytes, to w and returns its size. The new file is written in order,
+// so only the old one needs to be read at random.
+func applyPatch(old io.ReaderAt, oldSize int64, patch []byte, w io.Writer) (int64, error) {
+	if len(patch) < 32 || string(patch[:8]) != patchMagic {
+		return 0, errors.New("not a bsdiff patch")
+	}
+	controlLength := patchInt(patch[8:16])
+	diffLength := patchInt(patch[16:24])
+	newSize := patchInt(patch[24:32])
+	if controlLength < 0 || diffLength < 0 || newSize < 0 || controlLength > int64(len(patch)-32) || diffLength > int64(len(patch)-32)-controlLength {
+		return 0, errors.New("corrupt patch header")
+	}
+	// the control, diff and extra blocks are each compressed with bzip2
+	diffStart := 32 + controlLength
+	extraStart := diffStart + diffLength
+	control := bzip2.NewReader(bytes.NewReader(patch[32:diffStart]))
+	diff := bzip2.NewReader(bytes.NewReader(patch[diffStart:extraStart]))
+	extra := bzip2.NewReader(bytes.NewReader(patch[extraStart:]))
+
+	corrupt := func(err error) (int64, error) {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, errors.New("patch is truncated")
+		}
+		return 0, fmt.Errorf("corrupt patch : %v", err)
+	}
+	chunk := make([]byte, 64<<10)
+	oldChunk := make([]byte, len(chunk))
+	entry := make([]byte, 24)
+	var newPosition, oldPosition int64
+	for newPosition < newSize {
+		// add diffLength bytes to the old file, copy extraLength new ones,
+		// then move in the old file by seek
+		if _, err := io.ReadFull(control, entry); err != nil {
+			return corrupt(err)
+		}
+		diffLength, extraLength, seek := patchInt(entry[0:8]), patchInt(entry[8:16]), patchInt(entry[16:24])
+		if diffLength < 0 || extraLength < 0 || diffLength > newSize-newPosition || extraLength > newSize-newPosition-diffLength {
+			return 0, errors.New("corrupt patch, it writes past the end of the file")
+		}
+		for remaining := diffLength; remaining > 0; {
+			data := chunk[:min(remaining, int64(len(chunk)))]
+			if _, err := io.ReadFull(diff, data); err != nil {
+				return corrupt(err)
+			}
+			// bytes before or past the old file are taken as zero
+			start, end := max(oldPosition, 0), min(oldPosition+int64(len(data)), oldSize)
+			if start < end {
+				oldData := oldChunk[:end-start]
+				if _, err := old.ReadAt(oldData, start); err != nil {
+					return 0, err
+				}
+				offset := start - oldPosition
+				for i, b := range oldData {
+					data[offset+int64(i)] += b
+				}
+			}
+			if _, err := w.Write(data); err != nil {
+				return 0, err
+			}
+			remaining -= int64(len(data))
+			oldPosition += int64(len(data))
+			newPosition += int64(len(data))
+		}
+		if _, err := io.CopyN(w, extra, extraLength); err != nil {
+			if err == io.EOF {
+				return corrupt(err)
+			}
+			return 0, err
+		}
+		newPosition += extraLength
+		oldPosition += seek
+	}
+	return newPosition, nil
+}
+
+// patchInt decodes the sign and magnitude numbers of a bsdiff patch
+func patchInt(b []byte) int64 {
+	n := int64(binary.LittleEndian.Uint64(b) &^ (1 << 63))
+	if b[7]&0x80 != 0 {
+		return -n
+	}
+	return n
+}
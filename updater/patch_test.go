@@ -0,0 +1,117 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a bsdiff 4 patch from "hello world\n" followed by patchFiller to "Hello
+// there world!\n" followed by patchFiller. Its control block changes a byte,
+// inserts new bytes twice and copies the rest of the old file.
+var knownPatch, _ = hex.DecodeString("" +
+	"4253444946463430320000000000000031000000000000001310000000000000" +
+	"425a6839314159265359eaef112a00000ce0006b0850002000310c0818993438" +
+	"d5849db817362af177245385090eaef112a0425a68393141592653593d10d25d" +
+	"000022e001c000008040000008200030cd340a91942f912f061772453850903d" +
+	"10d25d425a6839314159265359775981000000031180600002401400200030c0" +
+	"086343414b85dc914e14241dd6604000")
+
+var patchFiller = strings.Repeat("0123456789abcdef", 256)
+
+func TestApplyPatch(t *testing.T) {
+	old := "hello world\n" + patchFiller
+	want := "Hello there world!\n" + patchFiller
+	var result bytes.Buffer
+	written, err := applyPatch(strings.NewReader(old), int64(len(old)), knownPatch, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != int64(len(want)) || result.String() != want {
+		t.Errorf("patch wrote %d bytes %q..., want %d bytes %q...", written, result.String()[:20], len(want), want[:20])
+	}
+}
+
+func TestApplyPatchCorrupt(t *testing.T) {
+	old := "hello world\n" + patchFiller
+	// cut off in the middle of the control block
+	truncated := knownPatch[:60]
+	badMagic := append([]byte("BSDIFF39"), knownPatch[8:]...)
+	// a control block longer than the whole patch
+	badHeader := append([]byte{}, knownPatch...)
+	badHeader[8] = 0xff
+	for name, patch := range map[string][]byte{
+		"empty":     nil,
+		"truncated": truncated,
+		"magic":     badMagic,
+		"header":    badHeader,
+	} {
+		if _, err := applyPatch(strings.NewReader(old), int64(len(old)), patch, &bytes.Buffer{}); err == nil {
+			t.Errorf("%s patch was applied", name)
+		}
+	}
+}
+
+func TestPatchInt(t *testing.T) {
+	for encoded, want := range map[string]int64{
+		"0000000000000000": 0,
+		"0500000000000000": 5,
+		"0500000000000080": -5,
+		"0001000000000000": 256,
+	} {
+		b, _ := hex.DecodeString(encoded)
+		if got := patchInt(b); got != want {
+			t.Errorf("patchInt(%s) = %d, want %d", encoded, got, want)
+		}
+	}
+}
+
+func TestUpdatePatch(t *testing.T) {
+	dir := chdirTemp(t)
+	old := "hello world\n" + patchFiller
+	content := "Hello there world!\n" + patchFiller
+	oldHash, err := CalculateHash(strings.NewReader(old), DefaultHashAlgo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := CalculateHash(strings.NewReader(content), DefaultHashAlgo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only the patch is served, so the file can't be downloaded whole
+	writeFile(t, filepath.Join("source", "patches", "a.bsdiff"), string(knownPatch))
+	repo := &Repository{
+		DownloadRoot: filepath.Join(dir, "source"),
+		HashAlgo:     DefaultHashAlgo,
+		Files: []File{{
+			Name:    "a.txt",
+			Hash:    hash,
+			Size:    int64(len(content)),
+			Patches: []Patch{{From: oldHash, Name: "patches/a.bsdiff"}},
+		}},
+	}
+	manifest := filepath.Join(dir, "updater.json")
+	if err := repo.Save(manifest); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join("install", "a.txt"), old)
+	if err := os.Chdir("install"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Update(context.Background(), UpdateOptions{RepoURL: manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Downloaded) != 1 {
+		t.Errorf("downloaded %v, failed %v", report.Downloaded, report.Failed)
+	}
+	if patched, err := ioutil.ReadFile("a.txt"); err != nil || string(patched) != content {
+		t.Errorf("a.txt was not patched: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package updater
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A manifest can ask for a command to be run on every downloaded file of a
+// type, such as extracting a nested archive. The commands come from the
+// server, so they are only run when the player allows it with
+// UpdateOptions.PostDownload, and otherwise only mentioned.
+
+// pathPlaceholder is replaced with the path of the downloaded file in a
+// Repository.PostDownload command
+const pathPlaceholder = "{path}"
+
+// postDownloadCommand returns the command the manifest has for rf, if any.
+// Extensions are compared without case.
+func (r *Repository) postDownloadCommand(rf File) (string, bool) {
+	extension := strings.ToLower(path.Ext(rf.Name))
+	for key, command := range r.PostDownload {
+		if strings.ToLower(key) == extension && len(extension) > 0 {
+			return command, true
+		}
+	}
+	return "", false
+}
+
+// runPostDownload runs the PostDownload commands of repo for the files that
+// were downloaded in this run, in the order of the manifest, and returns the
+// ones whose command failed. Without options.PostDownload the commands are
+// only counted.
+func runPostDownload(ctx context.Context, repo *Repository, downloaded []string, options UpdateOptions) []FileError {
+	out := options.Output
+	done := map[string]bool{}
+	for _, name := range downloaded {
+		done[name] = true
+	}
+	var files []File
+	for _, rf := range repo.Files {
+		if _, found := repo.postDownloadCommand(rf); found && done[rf.Name] && len(rf.Link) == 0 {
+			files = append(files, rf)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	if options.PostDownload == nil {
+		extensions := make([]string, 0, len(repo.PostDownload))
+		for extension := range repo.PostDownload {
+			extensions = append(extensions, extension)
+		}
+		sort.Strings(extensions)
+		fmt.Fprintf(out, "\nThe repository has commands to run on %d of the downloaded files (%s), they were not run\n", len(files), strings.Join(extensions, ", "))
+		options.Logger.Info("post-download commands not allowed", "files", len(files))
+		return nil
+	}
+
+	fmt.Fprintln(out, "")
+	fmt.Fprintf(out, "Running the commands of the repository on %d downloaded files\n", len(files))
+	var failed []FileError
+	for _, rf := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		template, _ := repo.postDownloadCommand(rf)
+		command := strings.ReplaceAll(template, pathPlaceholder, quotePath(filepath.FromSlash(rf.Name)))
+		options.Logger.Info("running post-download command", "file", rf.Name, "command", command)
+		if err := options.PostDownload(command); err != nil {
+			fmt.Fprintln(out, "Command for", rf.Name, "failed :", err)
+			options.Logger.Warn("post-download command failed", "file", rf.Name, "command", command, "error", err)
+			failed = append(failed, FileError{rf.Name, fmt.Sprintf("post-download command failed : %v", err)})
+		}
+	}
+	return failed
+}
+
+// quotePath puts a path with spaces in double quotes, which keeps it one
+// argument for the updater's command line and for most shells
+func quotePath(name string) string {
+	if strings.ContainsAny(name, " \t") {
+		return `"` + name + `"`
+	}
+	return name
+}
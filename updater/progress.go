@@ -0,0 +1,255 @@
+package updater
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redrawInterval is how often the progress line is redrawn at most, so
+// that the many small reads of the workers don't make it flicker
+const redrawInterval = 100 * time.Millisecond
+
+// downloadProgress keeps track of the bytes fetched by all download workers
+// and shows them on a single line that is redrawn in place, by a ticker
+// when the shown values change. When the output is not a terminal the line
+// is printed again every 10 percent instead.
+type downloadProgress struct {
+	mutex       sync.Mutex
+	out         io.Writer
+	total       int64
+	done        int64
+	started     time.Time
+	tty         bool
+	color       bool
+	lastPercent int64
+	lineLength  int
+	// in compact mode finished files only update the progress line, see
+	// ShowFiles
+	compact       bool
+	files         int
+	finishedFiles int
+	lastFile      string
+	// the line as it was last drawn
+	drawnLine string
+	// closed by Finish to stop the ticker
+	stop     chan struct{}
+	finished bool
+}
+
+func newDownloadProgress(out io.Writer, tty bool, color bool, total int64) *downloadProgress {
+	p := &downloadProgress{
+		out:     out,
+		total:   total,
+		started: time.Now(),
+		tty:     tty,
+		color:   color,
+		stop:    make(chan struct{}),
+	}
+	if tty {
+		go p.redraw()
+	}
+	return p
+}
+
+// redraw draws the line when it has changed, until Finish
+func (p *downloadProgress) redraw() {
+	ticker := time.NewTicker(redrawInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.mutex.Lock()
+			if line := p.line(); line != p.drawnLine && !p.finished {
+				p.draw()
+			}
+			p.mutex.Unlock()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// AddTotal grows the expected size, used when the manifest did not know
+// the size of a file but the server sent a Content-Length
+func (p *downloadProgress) AddTotal(n int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.total += n
+}
+
+// Add records n downloaded bytes. Negative values undo the bytes of a
+// failed download so that a retry does not count them twice. A terminal
+// shows them on the next tick.
+func (p *downloadProgress) Add(n int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.done += n
+	if !p.tty {
+		p.draw()
+	}
+}
+
+// ShowFiles switches a terminal to the compact mode, where the progress line
+// counts the files out of count and shows the last one that finished
+// instead of printing a line for each. Elsewhere it changes nothing.
+func (p *downloadProgress) ShowFiles(count int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.compact = p.tty
+	p.files = count
+}
+
+// FileDone reports a file that is finished, such as action "Downloading"
+// for name. Failures always get a line of their own.
+func (p *downloadProgress) FileDone(action string, name string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.finishedFiles++
+	if p.compact && err == nil {
+		p.lastFile = name
+		p.draw()
+		return
+	}
+	p.clear()
+	if err != nil {
+		fmt.Fprintln(p.out, action, name, "...", colored(p.color, colorFailed, err.Error()))
+	} else {
+		fmt.Fprintln(p.out, action, name, "...", colored(p.color, colorOK, "OK"))
+	}
+	p.draw()
+}
+
+// Println prints a line of output without mixing it with the progress line
+func (p *downloadProgress) Println(a ...interface{}) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.clear()
+	fmt.Fprintln(p.out, a...)
+	p.draw()
+}
+
+// Finish removes the progress line once all downloads are done
+func (p *downloadProgress) Finish() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.finished {
+		p.finished = true
+		close(p.stop)
+	}
+	p.clear()
+}
+
+func (p *downloadProgress) percent() int64 {
+	if p.total <= 0 {
+		return 0
+	}
+	percent := p.done * 100 / p.total
+	if percent > 100 {
+		percent = 100
+	}
+	return percent
+}
+
+func (p *downloadProgress) line() string {
+	rate := int64(0)
+	if elapsed := time.Since(p.started).Seconds(); elapsed > 0 {
+		rate = int64(float64(p.done) / elapsed)
+	}
+	if p.compact {
+		if len(p.lastFile) == 0 {
+			return fmt.Sprintf("[%d/%d] (%s/s)", p.finishedFiles, p.files, FormatBytes(rate))
+		}
+		return fmt.Sprintf("[%d/%d] %s ... OK (%s/s)", p.finishedFiles, p.files, p.lastFile, FormatBytes(rate))
+	}
+	return fmt.Sprintf("[%3d%%] %s / %s  %s/s", p.percent(), FormatBytes(p.done), FormatBytes(p.total), FormatBytes(rate))
+}
+
+func (p *downloadProgress) draw() {
+	if p.tty {
+		line := p.line()
+		fmt.Fprint(p.out, "\r", line)
+		p.lineLength = len(line)
+		p.drawnLine = line
+		return
+	}
+	if percent := p.percent(); percent/10 > p.lastPercent/10 {
+		p.lastPercent = percent
+		fmt.Fprintln(p.out, "Downloaded", p.line())
+	}
+}
+
+func (p *downloadProgress) clear() {
+	if p.tty && p.lineLength > 0 {
+		fmt.Fprint(p.out, "\r", strings.Repeat(" ", p.lineLength), "\r")
+		p.lineLength = 0
+		p.drawnLine = ""
+	}
+}
+
+// progressReader reports every read from the wrapped reader to a
+// downloadProgress and remembers how much it has reported
+type progressReader struct {
+	reader   io.Reader
+	progress *downloadProgress
+	count    int64
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+	if n > 0 {
+		r.count += int64(n)
+		r.progress.Add(int64(n))
+	}
+	return n, err
+}
+
+// FormatBytes returns n as a human readable size such as "1.5 MB"
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value := float64(n)
+	suffixes := []string{"KB", "MB", "GB", "TB"}
+	suffix := ""
+	for _, suffix = range suffixes {
+		value /= unit
+		if value < unit {
+			break
+		}
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
+
+// ParseBytes reads a size in the form printed by FormatBytes, such as "2MB"
+// or "1.5 GB". A plain number is bytes.
+func ParseBytes(size string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := float64(1)
+	for i, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		unit := math.Pow(1024, float64(i+1))
+		if strings.HasSuffix(value, suffix) {
+			value, multiplier = strings.TrimSuffix(value, suffix), unit
+			break
+		}
+		// "2M" is understood as well
+		if strings.HasSuffix(value, suffix[:1]) {
+			value, multiplier = strings.TrimSuffix(value, suffix[:1]), unit
+			break
+		}
+	}
+	value = strings.TrimSuffix(strings.TrimSpace(value), "B")
+	number, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	// ParseFloat takes "inf" and "NaN" too, and anything past the largest
+	// int64 would wrap around when converted
+	bytes := number * multiplier
+	if err != nil || number < 0 || math.IsNaN(bytes) || bytes >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return int64(bytes), nil
+}
@@ -0,0 +1,29 @@
+package updater
+
+import "testing"
+
+func TestParseBytes(t *testing.T) {
+	for _, test := range []struct {
+		size string
+		want int64
+	}{
+		{"0", 0},
+		{"100", 100},
+		{"100B", 100},
+		{"2k", 2048},
+		{"1.5 MB", 3 << 19},
+		{"2M", 2 << 20},
+		{" 1 gb ", 1 << 30},
+		{"1TB", 1 << 40},
+	} {
+		got, err := ParseBytes(test.size)
+		if err != nil || got != test.want {
+			t.Errorf("ParseBytes(%q) = %d, %v, want %d", test.size, got, err, test.want)
+		}
+	}
+	for _, size := range []string{"", "MB", "-1", "-1KB", "x", "inf", "+Inf", "NaN", "1e30", "9223372036854775807", "8388608TB"} {
+		if got, err := ParseBytes(size); err == nil {
+			t.Errorf("ParseBytes(%q) = %d, want an error", size, got)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package updater
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all downloads, so the limit holds
+// for the total rate however many files are downloaded at once
+type rateLimiter struct {
+	mutex sync.Mutex
+	// bytes per second
+	rate float64
+	// the most that can be read at once after being idle
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	// a quarter of a second keeps the rate smooth while still allowing
+	// reads of a reasonable size
+	burst := float64(bytesPerSecond) / 4
+	if burst < 1024 {
+		burst = 1024
+	}
+	return &rateLimiter{rate: float64(bytesPerSecond), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes n bytes from the bucket, sleeping until they have been earned
+// or ctx is cancelled
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mutex.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mutex.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// rateLimitedReader reads no faster than its limiter allows
+type rateLimitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+	ctx     context.Context
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	if len(b) > int(r.limiter.burst) {
+		b = b[:int(r.limiter.burst)]
+	}
+	n, err := r.reader.Read(b)
+	if waitError := r.limiter.wait(r.ctx, n); waitError != nil && err == nil {
+		err = waitError
+	}
+	return n, err
+}
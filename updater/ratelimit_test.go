@@ -0,0 +1,49 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaxRate(t *testing.T) {
+	dir := chdirTemp(t)
+	const fileSize = 48 << 10
+	const maxRate = 64 << 10
+	repo := &Repository{DownloadRoot: filepath.Join(dir, "source"), HashAlgo: DefaultHashAlgo}
+	for _, name := range []string{"a.bin", "b.bin"} {
+		content := bytes.Repeat([]byte(name), fileSize/len(name))
+		writeFile(t, filepath.Join("source", name), string(content))
+		hash, err := CalculateHash(bytes.NewReader(content), DefaultHashAlgo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo.Files = append(repo.Files, File{Name: name, Hash: hash, Size: int64(len(content))})
+	}
+	manifest := filepath.Join(dir, "updater.json")
+	if err := repo.Save(manifest); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join("install", ".keep"), "")
+	if err := os.Chdir("install"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the limit is shared, so two workers take as long as one would. Only
+	// the first burst of a quarter second comes for free
+	minimum := time.Duration(float64(2*fileSize-maxRate/4) / maxRate * float64(time.Second))
+	started := time.Now()
+	report, err := Update(context.Background(), UpdateOptions{RepoURL: manifest, MaxRate: maxRate, Concurrency: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < minimum {
+		t.Errorf("downloaded %d bytes in %v at %d bytes per second, expected at least %v", 2*fileSize, elapsed, maxRate, minimum)
+	}
+	if len(report.Downloaded) != 2 {
+		t.Errorf("downloaded %v, want both files", report.Downloaded)
+	}
+}
@@ -0,0 +1,91 @@
+package updater
+
+import "time"
+
+// Report describes the outcome of Update. It is also printed as JSON with
+// the -json flag, so the field names are kept stable. File names are slash
+// separated paths as they appear in the manifest.
+//
+//	Unchanged:       files that already matched the repository
+//	Missing:         files that did not exist before the run
+//	Changed:         files whose checksum did not match before the run
+//	Kept:            files that did not match but were left alone, as they
+//	                 have not changed since -changedSince
+//	Downloaded:      files that were successfully downloaded
+//	Failed:          files that could not be downloaded, with the reason
+//	Skipped:         files that could not be checked, with the reason
+//	Pruned:          files removed because they are not in the repository,
+//	                 or that would be removed with -dryRun
+//	WouldPrune:      files that would have been removed, with -pruneDryRun
+//	Unverified:      files that still didn't match the repository when
+//	                 checked again with -verifyAfter, with the reason
+//	Optional:        the optional files of the repository that were checked
+//	OptionalMissing: optional files that are not installed and were left
+//	                 out with -skipOptional, or found missing by -verify
+//	OptionalFailed:  optional files that could not be downloaded, with the
+//	                 reason. They don't count as Errors
+//	DownloadedBytes: total bytes written by the downloads
+//	Errors:          number of failed downloads
+//	Interrupted:     true if the run was cancelled before finishing
+//	Elapsed:         wall clock time of the run, in nanoseconds in JSON
+//	Run:             the command the manifest suggests running afterwards
+//
+// Lists that have no files are empty arrays, never null.
+type Report struct {
+	Unchanged       []string
+	Missing         []string
+	Changed         []string
+	Kept            []string
+	Downloaded      []string
+	Failed          []FileError
+	Skipped         []FileError
+	Pruned          []string
+	WouldPrune      []string
+	Unverified      []FileError
+	Optional        []string
+	OptionalMissing []string
+	OptionalFailed  []FileError
+	DownloadedBytes int64
+	Errors          int
+	Interrupted     bool
+	Elapsed         time.Duration
+	Run             string `json:",omitempty"`
+	// Version of the manifest, 0 if it wasn't fetched
+	ManifestVersion int `json:",omitempty"`
+}
+
+// FileError is a file and the reason it failed
+type FileError struct {
+	Name  string
+	Error string
+}
+
+func newReport() *Report {
+	return &Report{
+		Unchanged:       []string{},
+		Missing:         []string{},
+		Changed:         []string{},
+		Kept:            []string{},
+		Downloaded:      []string{},
+		Failed:          []FileError{},
+		Skipped:         []FileError{},
+		Pruned:          []string{},
+		WouldPrune:      []string{},
+		Unverified:      []FileError{},
+		Optional:        []string{},
+		OptionalMissing: []string{},
+		OptionalFailed:  []FileError{},
+	}
+}
+
+// failedFiles counts the files that failed, couldn't be checked or still
+// don't match, once each even when a failed download also fails to verify
+func (r *Report) failedFiles() int {
+	names := map[string]bool{}
+	for _, failures := range [][]FileError{r.Failed, r.Skipped, r.Unverified} {
+		for _, failure := range failures {
+			names[failure.Name] = true
+		}
+	}
+	return len(names)
+}
@@ -0,0 +1,14 @@
+package updater
+
+import "testing"
+
+func TestFailedFiles(t *testing.T) {
+	report := newReport()
+	report.Failed = []FileError{{"a.txt", "HTTP 404"}, {"b.txt", "HTTP 404"}}
+	report.Skipped = []FileError{{"c.txt", "permission denied"}}
+	// a download that failed doesn't match afterwards either
+	report.Unverified = []FileError{{"a.txt", "missing"}, {"d.txt", "changed"}}
+	if got := report.failedFiles(); got != 4 {
+		t.Errorf("failedFiles() = %d, want 4", got)
+	}
+}
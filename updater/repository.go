@@ -0,0 +1,797 @@
+// Package updater keeps a directory in sync with a repository described by
+// a JSON manifest, and creates such manifests from local directories.
+package updater
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrUnreachable is matched by errors.Is when the manifest could not be
+// downloaded from any of its addresses
+var ErrUnreachable = errors.New("repository could not be reached")
+
+// ErrEmptyRepository is matched by errors.Is when the manifest was fetched
+// but lists no usable files
+var ErrEmptyRepository = errors.New("repository has no files")
+
+// ErrInvalidManifest is matched by the errors of a manifest that was
+// fetched but can't be used, such as a malformed one or a bad signature
+var ErrInvalidManifest = errors.New("repository data is invalid")
+
+// errManifestTooLarge is not a reason to call the repository unreachable
+var errManifestTooLarge = errors.New("manifest is too large")
+
+// unreachableError keeps the message of err while matching ErrUnreachable
+type unreachableError struct {
+	err error
+}
+
+func (e unreachableError) Error() string {
+	return e.err.Error()
+}
+
+func (e unreachableError) Is(target error) bool {
+	return target == ErrUnreachable
+}
+
+// invalidManifestError keeps the message of err while matching
+// ErrInvalidManifest
+type invalidManifestError struct {
+	err error
+}
+
+func (e invalidManifestError) Error() string {
+	return e.err.Error()
+}
+
+func (e invalidManifestError) Is(target error) bool {
+	return target == ErrInvalidManifest
+}
+
+// invalidManifest marks err as a problem of the manifest, unless it is
+// about reaching it or the run was cancelled
+func invalidManifest(err error) error {
+	if errors.Is(err, ErrUnreachable) || errors.Is(err, ErrEmptyRepository) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return invalidManifestError{err}
+}
+
+// Repository is the manifest served as updater.json
+type Repository struct {
+	// format of the manifest, see ManifestVersion. 0 is the same as 1
+	Version int `json:",omitempty"`
+	// oldest updater Version that handles this manifest correctly
+	MinUpdaterVersion string `json:",omitempty"`
+	// where to download a new updater from, DefaultUpdaterURL if not set
+	UpdaterURL string `json:",omitempty"`
+	// command line suggested to run after a successful update, such as the
+	// game launcher. The updater only runs it when asked to
+	Run          string `json:",omitempty"`
+	DownloadRoot string
+	// alternate download roots. A file is downloaded from the first root
+	// that works, trying DownloadRoot first and then the mirrors in order
+	Mirrors  []string `json:",omitempty"`
+	HashAlgo string
+	// default for files that don't set their own Compression
+	Compression string `json:",omitempty"`
+	// files matching these patterns are hashed as text with
+	// CalculateTextHash, see MatchGlob
+	TextFiles []string `json:",omitempty"`
+	// archives holding many of the files, used instead of downloading the
+	// files one by one when enough of them are needed
+	Bundles []Bundle `json:",omitempty"`
+	// addresses of other manifests whose files are added to this one, in
+	// order, relative to this manifest like DownloadRoot. Later ones win
+	// for files of the same name
+	Include []string `json:",omitempty"`
+	// patterns of files and directories that are never pruned, such as a
+	// folder of player settings. Added to UpdateOptions.PruneExclude
+	PruneExclude []string `json:",omitempty"`
+	// patterns of the paths the repository manages, taken from the top
+	// directory, such as "missions" or "@mods/*/addons". When set, pruning
+	// only walks the directories that can hold matching files and only
+	// removes those. Otherwise it covers the whole first directory of
+	// every file. PruneExclude still wins over these
+	Managed []string `json:",omitempty"`
+	// commands to run on each downloaded file by extension, such as
+	// {".zip": "unzip -o {path}"}. {path} is replaced with the path of the
+	// file. Only run when allowed, see UpdateOptions.PostDownload
+	PostDownload map[string]string `json:",omitempty"`
+	// when the manifest was made, as unix seconds. See File.Changed
+	Built int64 `json:",omitempty"`
+	// the release of the files, set by the publisher. With Deltas an updater
+	// that installed it can later fetch only what changed, see delta.go
+	Release string `json:",omitempty"`
+	// directory of the delta manifests, relative to this manifest like
+	// DownloadRoot
+	Deltas string `json:",omitempty"`
+	// only in a delta manifest: the release it updates from, and the files
+	// removed since then
+	Since   string   `json:",omitempty"`
+	Removed []string `json:",omitempty"`
+	Files   []File
+	// where the manifest was read from, the relative addresses in it are
+	// relative to this
+	manifestURL string
+}
+
+// File is stored in the manifest either as an object or in the original
+// ["name", "hash"] form, optionally followed by the download root as
+// ["name", "hash", "root"]
+type File struct {
+	Name string
+	Hash string
+	// size in bytes, 0 if the manifest does not record it
+	Size int64 `json:",omitempty"`
+	// modification time as unix seconds, 0 if the manifest does not record it
+	ModTime int64 `json:",omitempty"`
+	// the Built time of the manifest the content of the file last changed
+	// in, 0 if not known. Unlike ModTime it doesn't change when the file is
+	// only touched. See UpdateOptions.ChangedSince
+	Changed int64 `json:",omitempty"`
+	// how the file is compressed on the server, empty if it isn't. See
+	// CompressionGzip
+	Compression string `json:",omitempty"`
+	// downloads this file from here instead of the repository's
+	// DownloadRoot and mirrors, e.g. to serve large files from a CDN
+	DownloadRoot string `json:",omitempty"`
+	// makes the file a symlink to this slash separated path, relative to
+	// the directory of the link. A link has no hash, see symlink.go
+	Link string `json:",omitempty"`
+	// octal permissions such as "0755", so scripts and helper programs stay
+	// executable. Empty is 0644, see mode.go
+	Mode string `json:",omitempty"`
+	// hashes of the blocks of BlockSize bytes the file is made of, so a
+	// damaged copy can be repaired by downloading only the blocks that
+	// differ. See blocks.go
+	BlockSize int64    `json:",omitempty"`
+	Blocks    []string `json:",omitempty"`
+	// the file can be left out of an install, such as a pack of high
+	// resolution textures. It is downloaded like any other file, but not
+	// having it is not an error. See UpdateOptions.SkipOptional
+	Optional bool `json:",omitempty"`
+	// bsdiff patches from earlier copies, so a small change doesn't need
+	// the whole file downloaded again. See patch.go
+	Patches  []Patch `json:",omitempty"`
+	HashAlgo string  `json:"-"`
+	// hash with CalculateTextHash, set from Repository.TextFiles
+	NormalizeText bool `json:"-"`
+}
+
+func (f *File) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '[' {
+		var entry []string
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		if len(entry) != 2 && len(entry) != 3 {
+			return errors.New("Files entry does not contain 2 or 3 items")
+		}
+		f.Name = entry[0]
+		f.Hash = entry[1]
+		if len(entry) == 3 {
+			f.DownloadRoot = entry[2]
+		}
+		return nil
+	}
+	// the alias type drops this method so json.Unmarshal doesn't recurse
+	type plainFile File
+	return json.Unmarshal(data, (*plainFile)(f))
+}
+
+// HasValidPath checks that the file resolves to somewhere inside the current
+// directory, so a manifest can't write or prune outside of it
+func (f File) HasValidPath() bool {
+	currentPath, err := os.Getwd()
+	if err != nil {
+		return false
+	}
+	absolutePath, err := filepath.Abs(filepath.FromSlash(f.Name))
+	if err != nil {
+		return false
+	}
+	relativePath, err := filepath.Rel(currentPath, absolutePath)
+	if err != nil || filepath.IsAbs(relativePath) || relativePath == "." {
+		return false
+	}
+	return relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator))
+}
+
+// CheckHash reads r to the end and reports whether it matches the file's hash
+func (f File) CheckHash(r io.Reader) bool {
+	hash, err := f.calculateHash(r)
+	return err == nil && hash == f.Hash
+}
+
+func (f File) calculateHash(r io.Reader) (string, error) {
+	if f.NormalizeText {
+		return CalculateTextHash(r, f.HashAlgo)
+	}
+	return CalculateHash(r, f.HashAlgo)
+}
+
+// cacheAlgo keeps text hashes apart from the plain ones in the hash cache
+func (f File) cacheAlgo() string {
+	if f.NormalizeText {
+		return f.HashAlgo + "+text"
+	}
+	return f.HashAlgo
+}
+
+// LoadRepository reads a manifest written by Save
+func LoadRepository(name string) (*Repository, error) {
+	repositoryBytes, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repository{}
+	if err := json.Unmarshal(repositoryBytes, repo); err != nil {
+		return nil, fmt.Errorf("malformed repository data in %s: %v", name, describeJSONError(repositoryBytes, err))
+	}
+	// matched by name against the files on disk, see normalizeName
+	for i := range repo.Files {
+		repo.Files[i].Name = normalizeName(repo.Files[i].Name)
+	}
+	return repo, nil
+}
+
+// Save writes the repository to name as indented JSON. Together with the
+// sorted files from CreateRepository this keeps the manifest readable in
+// diffs.
+func (r *Repository) Save(name string) error {
+	return r.SaveSigned(name, nil)
+}
+
+// SaveSigned is Save that also writes the signature of the manifest to
+// name + SignatureSuffix when key is not nil. Both write the checksum of the
+// manifest to name + ChecksumSuffix.
+func (r *Repository) SaveSigned(name string, key ed25519.PrivateKey) error {
+	repoBytes, marshalError := json.MarshalIndent(r, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+	repoBytes = append(repoBytes, '\n')
+	if writeError := ioutil.WriteFile(name, repoBytes, 0644); writeError != nil {
+		return writeError
+	}
+	if writeError := ioutil.WriteFile(name+ChecksumSuffix, manifestChecksum(repoBytes, filepath.Base(name)), 0644); writeError != nil {
+		return writeError
+	}
+	if key == nil {
+		return nil
+	}
+	return ioutil.WriteFile(name+SignatureSuffix, Sign(repoBytes, key), 0644)
+}
+
+// FetchRepository fetches the manifest from the first of the comma separated
+// options.RepoURL addresses that responds. An address can also be a local
+// path or a file:// URL, and a relative DownloadRoot is taken relative to
+// the manifest. A manifest that doesn't match the checksum served next to it
+// counts as not responding, as does one whose signature doesn't match when
+// options.VerifyKey is set. Malformed file entries are reported to
+// options.Output and left out. The manifests in Include are merged in, see
+// includeRepositories. On a filesystem that ignores case, a manifest listing
+// the same file twice in different case is invalid.
+func FetchRepository(ctx context.Context, options UpdateOptions) (*Repository, error) {
+	options.setDefaults()
+	out := options.Output
+	// a run that only looks doesn't write anything, not even the cache
+	cache := loadHashCache(options.CacheFile)
+	if !options.DryRun {
+		defer func() {
+			if saveError := cache.Save(); saveError != nil {
+				options.Logger.Warn("saving hash cache failed", "path", options.CacheFile, "error", saveError)
+			}
+		}()
+	}
+
+	var repositoryBytes []byte
+	var fetchError error
+	var manifestURL string
+	// where the manifest was found after following redirects
+	var resolvedURL string
+	for i, address := range strings.Split(options.RepoURL, ",") {
+		manifestURL = strings.TrimSpace(address)
+		if i > 0 {
+			fmt.Fprintln(out, fetchError)
+			fmt.Fprintln(out, "Trying", manifestURL)
+			options.Logger.Warn("falling back to next repository address", "error", fetchError)
+		}
+		if isLocalPath(manifestURL) {
+			if manifestURL, fetchError = fileURL(manifestURL); fetchError != nil {
+				continue
+			}
+		}
+		repositoryBytes, resolvedURL, fetchError = fetchVerified(ctx, options, cache, manifestURL)
+		if fetchError == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		fetchError = fmt.Errorf("unable to get repository data from %s: %w", manifestURL, fetchError)
+	}
+	if fetchError != nil {
+		return nil, invalidManifest(fetchError)
+	}
+
+	repo, entries, parseError := parseRepository(repositoryBytes, resolvedURL, options)
+	if parseError != nil {
+		return nil, invalidManifest(parseError)
+	}
+	if len(options.SaveManifest) > 0 {
+		// a copy that can't be saved is no reason to stop the update
+		if saveError := ioutil.WriteFile(options.SaveManifest, repositoryBytes, 0644); saveError != nil {
+			fmt.Fprintln(out, "Unable to save the manifest:", saveError)
+			options.Logger.Warn("saving manifest failed", "path", options.SaveManifest, "error", saveError)
+		} else {
+			options.Logger.Info("saved manifest", "url", resolvedURL, "path", options.SaveManifest, "bytes", len(repositoryBytes))
+		}
+	}
+	included := map[string]bool{resolvedURL: true}
+	includedEntries, includeError := includeRepositories(ctx, options, cache, repo, resolvedURL, included)
+	if includeError != nil {
+		return nil, invalidManifest(includeError)
+	}
+	entries += includedEntries
+	// links from one manifest can lead files from another astray
+	skipThroughLinks(repo, options)
+	if entries == 0 {
+		return nil, ErrEmptyRepository
+	}
+	if len(repo.Files) == 0 {
+		return nil, fmt.Errorf("%w that are valid, all %d entries were skipped", ErrEmptyRepository, entries)
+	}
+	if caseInsensitive() {
+		if collisionError := checkCaseCollisions(repo.Files); collisionError != nil {
+			return nil, invalidManifest(collisionError)
+		}
+	}
+	options.Logger.Debug("fetched repository", "url", resolvedURL, "files", len(repo.Files), "downloadRoot", repo.DownloadRoot, "mirrors", len(repo.Mirrors), "included", len(included)-1)
+	return repo, nil
+}
+
+// fetchVerified fetches a manifest and checks it against its checksum and,
+// with options.VerifyKey, its signature. An error of the fetch itself
+// matches ErrUnreachable.
+func fetchVerified(ctx context.Context, options UpdateOptions, cache *hashCache, manifestURL string) ([]byte, string, error) {
+	repositoryBytes, resolvedURL, fetchError := fetchManifest(ctx, options, manifestURL, cache)
+	if errors.Is(fetchError, errManifestTooLarge) {
+		return nil, resolvedURL, fetchError
+	} else if fetchError != nil {
+		return nil, resolvedURL, unreachableError{fetchError}
+	}
+	if resolvedURL != manifestURL {
+		fmt.Fprintln(options.Output, "Redirected to", resolvedURL)
+		options.Logger.Info("manifest redirected", "url", manifestURL, "resolved", resolvedURL)
+	}
+	if checksumError := checkManifestChecksum(ctx, options, resolvedURL, repositoryBytes); checksumError != nil {
+		return nil, resolvedURL, checksumError
+	}
+	if options.VerifyKey != nil {
+		if verifyError := verifyManifest(ctx, options, resolvedURL, repositoryBytes); verifyError != nil {
+			return nil, resolvedURL, verifyError
+		}
+	}
+	return repositoryBytes, resolvedURL, nil
+}
+
+// maxIncludes limits how many manifests a repository can pull in, counting
+// the nested ones
+const maxIncludes = 32
+
+// includeRepositories merges the manifests listed in repo.Include into repo
+// in order, after its own files. An entry replaces the one of the same name
+// from an earlier manifest and a different hash for it is reported as a
+// conflict. Included files are downloaded from the DownloadRoot of their own
+// manifest, without its mirrors. included holds the manifests merged so far
+// so that includes can't loop. It returns the number of entries included.
+func includeRepositories(ctx context.Context, options UpdateOptions, cache *hashCache, repo *Repository, manifestURL string, included map[string]bool) (int, error) {
+	out := options.Output
+	entries := 0
+	for _, include := range repo.Include {
+		includeURL, err := resolveDownloadRoot(manifestURL, include)
+		if err != nil {
+			return entries, fmt.Errorf("invalid Include %q: %v", include, err)
+		}
+		if included[includeURL] {
+			fmt.Fprintln(out, "Skipping Include", includeURL, ": already included")
+			options.Logger.Warn("repository included twice", "url", includeURL, "by", manifestURL)
+			continue
+		}
+		if len(included) > maxIncludes {
+			return entries, fmt.Errorf("too many included repositories, at most %d are allowed", maxIncludes)
+		}
+		included[includeURL] = true
+
+		fmt.Fprintln(out, "Including", includeURL)
+		includeBytes, resolvedURL, fetchError := fetchVerified(ctx, options, cache, includeURL)
+		if fetchError != nil {
+			// going on without it would prune the files it provides
+			return entries, fmt.Errorf("unable to get included repository data from %s: %w", includeURL, fetchError)
+		}
+		includedRepo, includedEntries, parseError := parseRepository(includeBytes, resolvedURL, options)
+		if parseError != nil {
+			return entries, fmt.Errorf("included repository %s: %w", includeURL, parseError)
+		}
+		entries += includedEntries
+		for i := range includedRepo.Files {
+			if len(includedRepo.Files[i].DownloadRoot) == 0 {
+				includedRepo.Files[i].DownloadRoot = includedRepo.DownloadRoot
+			}
+		}
+		nestedEntries, nestedError := includeRepositories(ctx, options, cache, includedRepo, resolvedURL, included)
+		entries += nestedEntries
+		if nestedError != nil {
+			return entries, nestedError
+		}
+		repo.Files = mergeFiles(repo.Files, includedRepo.Files, includeURL, options)
+		repo.PruneExclude = append(repo.PruneExclude, includedRepo.PruneExclude...)
+		repo.Managed = append(repo.Managed, includedRepo.Managed...)
+	}
+	return entries, nil
+}
+
+// mergeFiles adds newFiles from the manifest at source to files, replacing
+// the entries of the same name
+func mergeFiles(files []File, newFiles []File, source string, options UpdateOptions) []File {
+	positions := make(map[string]int, len(files))
+	for i, rf := range files {
+		positions[rf.Name] = i
+	}
+	for _, rf := range newFiles {
+		i, found := positions[rf.Name]
+		if !found {
+			positions[rf.Name] = len(files)
+			files = append(files, rf)
+			continue
+		}
+		if files[i].Hash != rf.Hash || files[i].Link != rf.Link {
+			fmt.Fprintf(options.Output, "Conflict: %s from %s replaces a different version of the same file\n", rf.Name, source)
+			options.Logger.Warn("conflicting Files entry", "file", rf.Name, "include", source, "hash", rf.Hash, "replaced", files[i].Hash)
+		}
+		files[i] = rf
+	}
+	return files
+}
+
+// parseRepository checks and decodes a fetched manifest, resolving its
+// download roots relative to resolvedURL. It also returns the number of
+// entries in Files, including the malformed ones that were left out.
+func parseRepository(repositoryBytes []byte, resolvedURL string, options UpdateOptions) (*Repository, int, error) {
+	out := options.Output
+	// entries are decoded one by one so that a malformed entry only skips
+	// itself instead of the whole manifest
+	var data struct {
+		Repository
+		Files []json.RawMessage
+	}
+	document, decodeError := decodeForSchema(repositoryBytes)
+	if decodeError != nil {
+		return nil, 0, fmt.Errorf("malformed repository data: %v", describeJSONError(repositoryBytes, decodeError))
+	}
+	// a newer format may not pass the schema of this version at all, so the
+	// version is checked first
+	version := manifestVersion(document)
+	if version > ManifestVersion {
+		return nil, 0, fmt.Errorf("the repository uses manifest version %d but this updater only supports version %d, please upgrade the updater", version, ManifestVersion)
+	}
+	if err := checkUpdaterVersion(document); err != nil {
+		return nil, 0, err
+	}
+	if schemaError := manifestSchema.validate(document, ""); schemaError != nil {
+		return nil, 0, fmt.Errorf("invalid repository data (manifest version %d): %v", version, schemaError)
+	}
+	if err := json.Unmarshal(repositoryBytes, &data); err != nil {
+		return nil, 0, fmt.Errorf("malformed repository data: %v", describeJSONError(repositoryBytes, err))
+	}
+	fileDocuments, _ := document.(map[string]interface{})["Files"].([]interface{})
+	roots := append([]string{data.DownloadRoot}, data.Mirrors...)
+	for i := range roots {
+		var err error
+		if roots[i], err = resolveDownloadRoot(resolvedURL, roots[i]); err != nil {
+			return nil, 0, err
+		}
+		if err = checkDownloadRoot(roots[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+	data.DownloadRoot, data.Mirrors = roots[0], roots[1:]
+	if len(data.Deltas) > 0 {
+		var err error
+		if data.Deltas, err = resolveDownloadRoot(resolvedURL, data.Deltas); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if len(data.HashAlgo) == 0 {
+		data.HashAlgo = DefaultHashAlgo
+	}
+	if _, err := NewHash(data.HashAlgo); err != nil {
+		return nil, 0, err
+	}
+
+	var files []File
+	seen := map[string]bool{}
+	for i, entry := range data.Files {
+		if i < len(fileDocuments) {
+			if schemaError := manifestSchema.Defs["File"].validate(fileDocuments[i], fmt.Sprintf("Files[%d]", i)); schemaError != nil {
+				fmt.Fprintf(out, "Skipping malformed Files entry %d: %v\n", i, schemaError)
+				options.Logger.Warn("malformed Files entry", "index", i, "error", schemaError)
+				continue
+			}
+		}
+		var newEntry File
+		if err := json.Unmarshal(entry, &newEntry); err != nil {
+			fmt.Fprintf(out, "Skipping malformed Files entry %d: %v\n", i, err)
+			options.Logger.Warn("malformed Files entry", "index", i, "error", err)
+			continue
+		}
+		if len(newEntry.Name) == 0 || (len(newEntry.Hash) == 0 && len(newEntry.Link) == 0) {
+			fmt.Fprintf(out, "Skipping malformed Files entry %d: missing name or hash\n", i)
+			options.Logger.Warn("malformed Files entry", "index", i, "error", "missing name or hash")
+			continue
+		}
+		// checked before anything else is done with the name, as the
+		// manifest comes from the network
+		if unsafeError := checkName(newEntry.Name); unsafeError != nil {
+			fmt.Fprintf(out, "Skipping Files entry %d: %v\n", i, unsafeError)
+			options.Logger.Warn("unsafe Files entry", "index", i, "file", newEntry.Name, "error", unsafeError)
+			continue
+		}
+		newEntry.Name = normalizeName(newEntry.Name)
+		if seen[newEntry.Name] {
+			fmt.Fprintf(out, "Skipping Files entry %d: %s is listed more than once\n", i, newEntry.Name)
+			options.Logger.Warn("duplicate Files entry", "index", i, "file", newEntry.Name)
+			continue
+		}
+		seen[newEntry.Name] = true
+		if len(newEntry.Link) > 0 && !newEntry.hasValidLink() {
+			fmt.Fprintf(out, "Skipping Files entry %d: symlink to %s points outside of the repository\n", i, newEntry.Link)
+			options.Logger.Warn("unsafe Files entry", "index", i, "link", newEntry.Link)
+			continue
+		}
+		newEntry.HashAlgo = data.HashAlgo
+		newEntry.NormalizeText = matchesAny(data.TextFiles, newEntry.Name)
+		if len(newEntry.Compression) == 0 {
+			newEntry.Compression = data.Compression
+		}
+		if len(newEntry.DownloadRoot) > 0 {
+			var rootError error
+			if newEntry.DownloadRoot, rootError = resolveDownloadRoot(resolvedURL, newEntry.DownloadRoot); rootError == nil {
+				rootError = checkDownloadRoot(newEntry.DownloadRoot)
+			}
+			if rootError != nil {
+				fmt.Fprintf(out, "Skipping malformed Files entry %d: %v\n", i, rootError)
+				options.Logger.Warn("malformed Files entry", "index", i, "error", rootError)
+				continue
+			}
+		}
+		if len(newEntry.Mode) > 0 {
+			if _, modeError := parseMode(newEntry.Mode); modeError != nil {
+				fmt.Fprintf(out, "Skipping malformed Files entry %d: %v\n", i, modeError)
+				options.Logger.Warn("malformed Files entry", "index", i, "error", modeError)
+				continue
+			}
+		}
+		if _, err := compressedSuffix(newEntry.Compression); err != nil {
+			fmt.Fprintf(out, "Skipping Files entry %d: %v\n", i, err)
+			options.Logger.Warn("unsupported Files entry", "index", i, "error", err)
+			continue
+		}
+		files = append(files, newEntry)
+	}
+	data.Repository.Files = files
+	// a delta's removals are pruned, so they get the same check
+	var removed []string
+	for _, name := range data.Removed {
+		if unsafeError := checkName(name); unsafeError != nil {
+			fmt.Fprintf(out, "Not removing %s: %v\n", name, unsafeError)
+			options.Logger.Warn("unsafe Removed entry", "file", name, "error", unsafeError)
+			continue
+		}
+		removed = append(removed, normalizeName(name))
+	}
+	data.Repository.Removed = removed
+	skipThroughLinks(&data.Repository, options)
+	data.Repository.manifestURL = resolvedURL
+	return &data.Repository, len(data.Files), nil
+}
+
+// normalizeName makes a manifest name slash separated and clean, as names
+// written by hand or by older tools on Windows may use backslashes. Names
+// are compared as they are when pruning, so "./a" has to become "a" too.
+func normalizeName(name string) string {
+	return path.Clean(strings.ReplaceAll(name, `\`, "/"))
+}
+
+// checkName refuses entry names that could point outside of the current
+// directory: absolute paths, ones with a drive or volume and ones with ".."
+// in them, even where it would cancel out. HasValidPath checks again before
+// the file is touched.
+func checkName(name string) error {
+	slashed := strings.ReplaceAll(name, `\`, "/")
+	if path.IsAbs(slashed) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" || (len(slashed) >= 2 && slashed[1] == ':') {
+		return fmt.Errorf("%s is an absolute path", name)
+	}
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return fmt.Errorf("%s has .. in it", name)
+		}
+	}
+	if normalizeName(name) == "." {
+		return fmt.Errorf("%q is not a file name", name)
+	}
+	return nil
+}
+
+// manifestVersion reads the Version of a decoded manifest, 1 if it has none
+func manifestVersion(document interface{}) int {
+	fields, _ := document.(map[string]interface{})
+	number, _ := fields["Version"].(json.Number)
+	version, err := number.Int64()
+	if err != nil || version < 1 {
+		return 1
+	}
+	return int(version)
+}
+
+// checkUpdaterVersion refuses manifests that need a newer updater
+func checkUpdaterVersion(document interface{}) error {
+	fields, _ := document.(map[string]interface{})
+	minimum, _ := fields["MinUpdaterVersion"].(string)
+	if !versionBelow(Version, minimum) {
+		return nil
+	}
+	updaterURL, _ := fields["UpdaterURL"].(string)
+	if len(updaterURL) == 0 {
+		updaterURL = DefaultUpdaterURL
+	}
+	return fmt.Errorf("this repository needs updater version %s or newer but this is version %s, please download the latest updater from %s", minimum, Version, updaterURL)
+}
+
+// checkDownloadRoot makes sure files would be fetched from somewhere
+// sensible, as the file names are appended to it as is
+func checkDownloadRoot(downloadRoot string) error {
+	if len(downloadRoot) == 0 {
+		return errors.New("repository has no DownloadRoot")
+	}
+	parsedURL, err := url.Parse(downloadRoot)
+	if err != nil {
+		return fmt.Errorf("invalid download root %q: %v", downloadRoot, err)
+	}
+	if len(parsedURL.Scheme) == 0 || (len(parsedURL.Host) == 0 && parsedURL.Scheme != "file") {
+		return fmt.Errorf("invalid download root %q: not an absolute URL", downloadRoot)
+	}
+	return checkTemplate(downloadRoot)
+}
+
+// describeJSONError adds the line number to decoding errors, the offset alone
+// isn't much help when fixing a manifest by hand
+func describeJSONError(data []byte, err error) error {
+	var offset int64
+	switch jsonError := err.(type) {
+	case *json.SyntaxError:
+		offset = jsonError.Offset
+	case *json.UnmarshalTypeError:
+		offset = jsonError.Offset
+	default:
+		return err
+	}
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line := 1 + bytes.Count(data[:offset], []byte("\n"))
+	return fmt.Errorf("line %d: %v", line, err)
+}
+
+// fetchManifest returns the body of manifestURL and the address it was
+// finally read from after redirects. With a cache, the server is asked to
+// only send the body if it changed since the copy in the cache, and the
+// cache is updated with what it sends.
+func fetchManifest(ctx context.Context, options UpdateOptions, manifestURL string, cache *hashCache) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, options.Timeout)
+	defer cancel()
+	request, requestError := options.newRequest(ctx, manifestURL)
+	if requestError != nil {
+		return nil, manifestURL, requestError
+	}
+	// reading a local manifest again costs less than keeping a copy of it
+	if request.URL.Scheme == "file" {
+		cache = nil
+	}
+	var cached manifestCacheEntry
+	var haveCached bool
+	if cache != nil {
+		cached, haveCached = cache.LookupManifest(manifestURL)
+	}
+	// a large manifest shrinks a lot. It is asked for here instead of by the
+	// transport, which gives up on gzip when options.Header has an
+	// Accept-Encoding of its own, and decompressed below
+	request.Header.Set("Accept-Encoding", "gzip")
+	if haveCached && len(cached.ETag) > 0 {
+		request.Header.Set("If-None-Match", cached.ETag)
+	}
+	if haveCached && len(cached.LastModified) > 0 {
+		request.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+	options.Logger.Debug("fetching manifest", "url", manifestURL)
+	response, connectionError := options.Client.Do(request)
+	if connectionError != nil {
+		return nil, manifestURL, connectionError
+	}
+	defer response.Body.Close()
+
+	resolvedURL := response.Request.URL.String()
+	options.Logger.Debug("manifest response", "url", resolvedURL, "status", response.StatusCode, "length", response.ContentLength)
+	if redirectError := checkRedirect(response); redirectError != nil {
+		return nil, resolvedURL, redirectError
+	}
+	if response.StatusCode == 304 && haveCached {
+		options.Logger.Debug("manifest not modified, using the cached copy", "url", manifestURL)
+		return cached.Body, cached.ResolvedURL, nil
+	}
+	if response.StatusCode != 200 {
+		return nil, resolvedURL, fmt.Errorf("HTTP status code %d", response.StatusCode)
+	}
+	// whatever the server sends is read into memory, so it has to be
+	// limited. One byte over the limit is enough to tell
+	limit := options.MaxManifestSize
+	if response.ContentLength > limit {
+		return nil, resolvedURL, fmt.Errorf("%w, %s is over the limit of %s", errManifestTooLarge, FormatBytes(response.ContentLength), FormatBytes(limit))
+	}
+	var body io.Reader = response.Body
+	if strings.EqualFold(response.Header.Get("Content-Encoding"), "gzip") {
+		gzipReader, gzipError := gzip.NewReader(response.Body)
+		if gzipError != nil {
+			return nil, resolvedURL, fmt.Errorf("unable to decompress : %v", gzipError)
+		}
+		defer gzipReader.Close()
+		body = gzipReader
+		options.Logger.Debug("manifest is gzipped", "url", resolvedURL, "compressedLength", response.ContentLength)
+	}
+	// the limit is for the decompressed manifest
+	repositoryBytes, readError := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if int64(len(repositoryBytes)) > limit {
+		return nil, resolvedURL, fmt.Errorf("%w, it is over the limit of %s", errManifestTooLarge, FormatBytes(limit))
+	}
+	if readError == nil && cache != nil {
+		entry := manifestCacheEntry{
+			ResolvedURL:  resolvedURL,
+			ETag:         response.Header.Get("ETag"),
+			LastModified: response.Header.Get("Last-Modified"),
+			Body:         repositoryBytes,
+		}
+		// without validators the server can't tell whether it changed
+		if len(entry.ETag) > 0 || len(entry.LastModified) > 0 {
+			cache.StoreManifest(manifestURL, entry)
+		}
+	}
+	return repositoryBytes, resolvedURL, readError
+}
+
+// verifyManifest fetches the detached signature of the manifest and checks
+// it against options.VerifyKey
+func verifyManifest(ctx context.Context, options UpdateOptions, manifestURL string, repositoryBytes []byte) error {
+	signature, _, fetchError := fetchManifest(ctx, options, manifestURL+SignatureSuffix, nil)
+	if fetchError != nil {
+		return fmt.Errorf("unable to get manifest signature: %v", fetchError)
+	}
+	verifyError := VerifySignature(repositoryBytes, signature, options.VerifyKey)
+	options.Logger.Debug("verified manifest signature", "url", manifestURL, "error", verifyError)
+	return verifyError
+}
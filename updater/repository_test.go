@@ -0,0 +1,101 @@
+package updater
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHasValidPath(t *testing.T) {
+	dir := chdirTemp(t)
+	project := filepath.Join(dir, "project")
+	if err := os.MkdirAll(project, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(project); err != nil {
+		t.Fatal(err)
+	}
+	for name, valid := range map[string]bool{
+		"a.txt":                   true,
+		"addons/a.pbo":            true,
+		"addons/../a.txt":         true,
+		".":                       false,
+		"..":                      false,
+		"../escape":               false,
+		"addons/../../escape":     false,
+		"../project-evil/a.txt":   false,
+		filepath.ToSlash(project): false,
+		"/etc/passwd":             false,
+		filepath.ToSlash(filepath.Join(dir, "project-evil", "a.txt")): false,
+		filepath.ToSlash(filepath.Join(project, "a.txt")):             true,
+	} {
+		if got := (File{Name: name}).HasValidPath(); got != valid {
+			t.Errorf("HasValidPath(%q) = %v, want %v", name, got, valid)
+		}
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	for name, want := range map[string]string{
+		"addons/a.pbo":         "addons/a.pbo",
+		`addons\a.pbo`:         "addons/a.pbo",
+		`mods\addons/a.pbo`:    "mods/addons/a.pbo",
+		`mods/addons\a.pbo`:    "mods/addons/a.pbo",
+		`.\mods//addons\a.pbo`: "mods/addons/a.pbo",
+	} {
+		if got := normalizeName(name); got != want {
+			t.Errorf("normalizeName(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestUpdateMixedSeparators(t *testing.T) {
+	dir := chdirTemp(t)
+	repo := &Repository{DownloadRoot: filepath.Join(dir, "source"), HashAlgo: DefaultHashAlgo}
+	for _, name := range []string{`mods\a.txt`, "mods/b.txt", `mods\addons/c.txt`, `mods/addons\d.txt`} {
+		normalized := normalizeName(name)
+		writeFile(t, filepath.Join("source", filepath.FromSlash(normalized)), normalized)
+		hash, err := CalculateHash(strings.NewReader(normalized), DefaultHashAlgo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo.Files = append(repo.Files, File{Name: name, Hash: hash})
+	}
+	manifest := filepath.Join(dir, "updater.json")
+	if err := repo.Save(manifest); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join("install", "mods", "old.txt"), "old")
+	if err := os.Chdir("install"); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Update(context.Background(), UpdateOptions{RepoURL: manifest, Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mods/a.txt", "mods/b.txt", "mods/addons/c.txt", "mods/addons/d.txt"} {
+		content, err := ioutil.ReadFile(filepath.FromSlash(name))
+		if err != nil || string(content) != name {
+			t.Errorf("%s has %q, %v", name, content, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join("mods", "old.txt")); err == nil {
+		t.Error("unlisted file was not pruned")
+	}
+	if got := strings.Join(report.Pruned, ","); got != "mods/old.txt" {
+		t.Errorf("pruned %s, want only mods/old.txt", got)
+	}
+
+	// the files now match, so nothing is downloaded or pruned again
+	report, err = Update(context.Background(), UpdateOptions{RepoURL: manifest, Prune: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Downloaded) != 0 || len(report.Pruned) != 0 {
+		t.Errorf("second run downloaded %v and pruned %v", report.Downloaded, report.Pruned)
+	}
+}
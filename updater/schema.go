@@ -0,0 +1,162 @@
+package updater
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ManifestVersion is the newest manifest format this updater understands.
+// Manifests without a Version are version 1.
+const ManifestVersion = 1
+
+// manifestSchemaJSON describes the manifest. Files entries are checked
+// against $defs/File one at a time so a bad entry only skips itself.
+//
+//go:embed manifest.schema.json
+var manifestSchemaJSON []byte
+
+// schema is the small part of JSON schema that the manifest needs
+type schema struct {
+	Type       string             `json:"type"`
+	Properties map[string]*schema `json:"properties"`
+	Required   []string           `json:"required"`
+	Items      *schema            `json:"items"`
+	AnyOf      []*schema          `json:"anyOf"`
+	MinItems   *int               `json:"minItems"`
+	MaxItems   *int               `json:"maxItems"`
+	Minimum    *float64           `json:"minimum"`
+	Defs       map[string]*schema `json:"$defs"`
+}
+
+var manifestSchema = mustParseSchema(manifestSchemaJSON)
+
+func mustParseSchema(data []byte) *schema {
+	s := &schema{}
+	if err := json.Unmarshal(data, s); err != nil {
+		panic("invalid embedded schema: " + err.Error())
+	}
+	return s
+}
+
+// decodeForSchema decodes data keeping numbers as json.Number, so integers
+// can be told apart from other numbers
+func decodeForSchema(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	return value, err
+}
+
+func jsonType(value interface{}) string {
+	switch typedValue := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if strings.ContainsAny(typedValue.String(), ".eE") {
+			return "number"
+		}
+		return "integer"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// validate checks value against s. The error names the offending field by
+// its path in the manifest, e.g. "Files[3].Size".
+func (s *schema) validate(value interface{}, path string) error {
+	if len(s.AnyOf) > 0 {
+		return s.validateAnyOf(value, path)
+	}
+
+	valueType := jsonType(value)
+	if len(s.Type) > 0 && s.Type != valueType && !(s.Type == "number" && valueType == "integer") {
+		return fmt.Errorf("%s: expected %s, got %s", describePath(path), s.Type, valueType)
+	}
+
+	switch typedValue := value.(type) {
+	case json.Number:
+		if number, err := typedValue.Float64(); err == nil && s.Minimum != nil && number < *s.Minimum {
+			return fmt.Errorf("%s: must be at least %v", describePath(path), *s.Minimum)
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(typedValue) < *s.MinItems {
+			return fmt.Errorf("%s: expected at least %d items, got %d", describePath(path), *s.MinItems, len(typedValue))
+		}
+		if s.MaxItems != nil && len(typedValue) > *s.MaxItems {
+			return fmt.Errorf("%s: expected at most %d items, got %d", describePath(path), *s.MaxItems, len(typedValue))
+		}
+		if s.Items != nil {
+			for i, item := range typedValue {
+				if err := s.Items.validate(item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, found := typedValue[name]; !found {
+				return fmt.Errorf("%s: required field is missing", joinPath(path, name))
+			}
+		}
+		// sorted so that the same manifest always reports the same error
+		var names []string
+		for name := range s.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if fieldValue, found := typedValue[name]; found {
+				if err := s.Properties[name].validate(fieldValue, joinPath(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateAnyOf passes if one of the alternatives does. Otherwise the error
+// of the alternative with the same type as the value explains the problem
+// best.
+func (s *schema) validateAnyOf(value interface{}, path string) error {
+	var sameTypeError error
+	for _, alternative := range s.AnyOf {
+		err := alternative.validate(value, path)
+		if err == nil {
+			return nil
+		}
+		if alternative.Type == jsonType(value) {
+			sameTypeError = err
+		}
+	}
+	if sameTypeError != nil {
+		return sameTypeError
+	}
+	return fmt.Errorf("%s: %s is not allowed here", describePath(path), jsonType(value))
+}
+
+func joinPath(path string, name string) string {
+	if len(path) == 0 {
+		return name
+	}
+	return path + "." + name
+}
+
+func describePath(path string) string {
+	if len(path) == 0 {
+		return "manifest"
+	}
+	return path
+}
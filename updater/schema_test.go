@@ -0,0 +1,60 @@
+package updater
+
+import "testing"
+
+func TestManifestSchema(t *testing.T) {
+	for _, test := range []struct {
+		manifest string
+		err      string
+	}{
+		{`{"DownloadRoot": "https://example.com/", "Files": []}`, ""},
+		{`{"DownloadRoot": "https://example.com/", "Files": [["a.txt", "0a"]], "Version": 1}`, ""},
+		{`{"Files": []}`, "DownloadRoot: required field is missing"},
+		{`{"DownloadRoot": 1, "Files": []}`, "DownloadRoot: expected string, got integer"},
+		{`{"DownloadRoot": "", "Files": {}}`, "Files: expected array, got object"},
+		{`{"DownloadRoot": "", "Files": [], "Version": 1.5}`, "Version: expected integer, got number"},
+		{`{"DownloadRoot": "", "Files": [], "Version": 0}`, "Version: must be at least 1"},
+		{`[]`, "manifest: expected object, got array"},
+	} {
+		document, err := decodeForSchema([]byte(test.manifest))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = manifestSchema.validate(document, "")
+		if got := errorString(err); got != test.err {
+			t.Errorf("%s: got error %q, want %q", test.manifest, got, test.err)
+		}
+	}
+}
+
+func TestFileSchema(t *testing.T) {
+	for entry, valid := range map[string]bool{
+		`["a.txt", "0a"]`:                                 true,
+		`["a.txt", "0a", "lzma"]`:                         true,
+		`{"Name": "a.txt", "Hash": "0a", "Size": 1}`:      true,
+		`["a.txt"]`:                                       false,
+		`["a.txt", "0a", "lzma", "x"]`:                    false,
+		`["a.txt", 1]`:                                    false,
+		`{"Name": "a.txt"}`:                               false,
+		`{"Name": 1, "Hash": "0a"}`:                       false,
+		`{"Name": "a.txt", "Hash": "0a", "Size": -1}`:     false,
+		`{"Name": "a.txt", "Hash": "0a", "ModTime": "1"}`: false,
+		`"a.txt"`: false,
+	} {
+		document, err := decodeForSchema([]byte(entry))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = manifestSchema.Defs["File"].validate(document, "Files[0]")
+		if (err == nil) != valid {
+			t.Errorf("%s: got error %v, want valid %v", entry, err, valid)
+		}
+	}
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
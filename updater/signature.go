@@ -0,0 +1,66 @@
+package updater
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+)
+
+// SignatureSuffix is appended to the manifest name or address to get its
+// detached signature
+const SignatureSuffix = ".sig"
+
+// ParsePrivateKey reads an ed25519 private key in PEM encoded PKCS #8 form,
+// as written by "openssl genpkey -algorithm ed25519"
+func ParsePrivateKey(pemBytes []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found in private key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an ed25519 key")
+	}
+	return privateKey, nil
+}
+
+// ParsePublicKey reads a base64 encoded ed25519 public key
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	keyBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+	if len(keyBytes) != ed25519.PublicKeySize {
+		return nil, errors.New("public key is not an ed25519 key")
+	}
+	return ed25519.PublicKey(keyBytes), nil
+}
+
+// EncodePublicKey returns the base64 form read by ParsePublicKey
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// Sign returns the base64 encoded signature of data
+func Sign(data []byte, key ed25519.PrivateKey) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, data)) + "\n")
+}
+
+// VerifySignature checks a signature produced by Sign
+func VerifySignature(data []byte, signature []byte, key ed25519.PublicKey) error {
+	signatureBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return errors.New("malformed manifest signature")
+	}
+	if !ed25519.Verify(key, data, signatureBytes) {
+		return errors.New("manifest signature does not match, refusing to use it")
+	}
+	return nil
+}
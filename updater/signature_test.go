@@ -0,0 +1,93 @@
+package updater
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// signedManifest saves a signed manifest with one file as updater.json in
+// the current directory and returns its address and the public key
+func signedManifest(t *testing.T) (string, ed25519.PublicKey) {
+	t.Helper()
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &Repository{
+		DownloadRoot: "https://example.com/files/",
+		HashAlgo:     DefaultHashAlgo,
+		Files:        []File{{Name: "a.txt", Hash: "86f7e437faa5a7fce15d1ddcb9eaeaea377667b8"}},
+	}
+	if err := repo.SaveSigned("updater.json", privateKey); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.FileServer(http.Dir(".")))
+	t.Cleanup(server.Close)
+	return server.URL + "/updater.json", publicKey
+}
+
+func TestVerifyManifest(t *testing.T) {
+	chdirTemp(t)
+	manifestURL, publicKey := signedManifest(t)
+	if _, err := FetchRepository(context.Background(), UpdateOptions{RepoURL: manifestURL, VerifyKey: publicKey}); err != nil {
+		t.Errorf("signed manifest refused: %v", err)
+	}
+}
+
+func TestVerifyManifestTampered(t *testing.T) {
+	chdirTemp(t)
+	manifestURL, publicKey := signedManifest(t)
+	manifest, err := ioutil.ReadFile("updater.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(manifest, []byte(`"a.txt"`), []byte(`"b.txt"`), 1)
+	if bytes.Equal(tampered, manifest) {
+		t.Fatal("manifest was not changed")
+	}
+	if err := ioutil.WriteFile("updater.json", tampered, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a matching checksum, so only the signature can catch it
+	if err := ioutil.WriteFile("updater.json"+ChecksumSuffix, manifestChecksum(tampered, "updater.json"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FetchRepository(context.Background(), UpdateOptions{RepoURL: manifestURL, VerifyKey: publicKey}); err == nil {
+		t.Error("tampered manifest was accepted")
+	}
+}
+
+func TestVerifyManifestWrongKey(t *testing.T) {
+	chdirTemp(t)
+	manifestURL, _ := signedManifest(t)
+	otherKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FetchRepository(context.Background(), UpdateOptions{RepoURL: manifestURL, VerifyKey: otherKey}); err == nil {
+		t.Error("manifest signed with another key was accepted")
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`{"Files": []}`)
+	signature := Sign(data, privateKey)
+	if err := VerifySignature(data, signature, publicKey); err != nil {
+		t.Errorf("valid signature refused: %v", err)
+	}
+	if err := VerifySignature([]byte(`{"Files": [1]}`), signature, publicKey); err == nil {
+		t.Error("signature of other data was accepted")
+	}
+	if err := VerifySignature(data, []byte("not base64!"), publicKey); err == nil {
+		t.Error("malformed signature was accepted")
+	}
+}
@@ -0,0 +1,77 @@
+package updater
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// StateFileName is where Update remembers how its runs ended, so the next
+// one can tell the player whether the last update finished
+const StateFileName = ".updater-state.json"
+
+// RunState describes a run of Update in the state file
+type RunState struct {
+	Started time.Time
+	// zero until the run ends, so a run that was killed has none
+	Finished        time.Time
+	Repository      string
+	ManifestVersion int    `json:",omitempty"`
+	Files           int    `json:",omitempty"`
+	Errors          int    `json:",omitempty"`
+	Interrupted     bool   `json:",omitempty"`
+	Error           string `json:",omitempty"`
+}
+
+// updateState is the content of the state file
+type updateState struct {
+	path string
+	// the last run that brought every file up to date
+	LastSuccess *RunState `json:",omitempty"`
+	// the run going on or the one before it
+	LastRun *RunState `json:",omitempty"`
+}
+
+// loadUpdateState reads the state file. A missing or unreadable one is
+// taken as a first run.
+func loadUpdateState(path string) *updateState {
+	state := &updateState{path: path}
+	if stateBytes, readError := ioutil.ReadFile(path); readError == nil {
+		json.Unmarshal(stateBytes, state)
+	}
+	return state
+}
+
+func (s *updateState) Save() error {
+	stateBytes, marshalError := json.MarshalIndent(s, "", "  ")
+	if marshalError != nil {
+		return marshalError
+	}
+	return ioutil.WriteFile(s.path, append(stateBytes, '\n'), 0644)
+}
+
+// Print tells when the last successful update was, and what went wrong in
+// the run after it, if anything
+func (s *updateState) Print(out io.Writer) {
+	if last := s.LastSuccess; last != nil {
+		fmt.Fprintf(out, "Last successful update: %s (manifest v%d, %d files)\n", last.Finished.Local().Format("2006-01-02 15:04"), max(last.ManifestVersion, 1), last.Files)
+	}
+	previous := s.LastRun
+	// the last run was the successful one
+	if previous == nil || (s.LastSuccess != nil && previous.Started.Equal(s.LastSuccess.Started)) {
+		return
+	}
+	started := previous.Started.Local().Format("2006-01-02 15:04")
+	switch {
+	case previous.Finished.IsZero():
+		fmt.Fprintf(out, "The previous run, started %s, never finished. It may have been killed or the computer shut down\n", started)
+	case previous.Interrupted:
+		fmt.Fprintf(out, "The previous run at %s was interrupted\n", started)
+	case len(previous.Error) > 0:
+		fmt.Fprintf(out, "The previous run at %s failed : %s\n", started, previous.Error)
+	case previous.Errors > 0:
+		fmt.Fprintf(out, "The previous run at %s had %d errors\n", started, previous.Errors)
+	}
+}
@@ -0,0 +1,168 @@
+package updater
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Symbolic links are recorded in the manifest with their target instead of
+// a hash, and recreated as links on update. Only links to somewhere inside
+// the repository are recorded, and CreateRepository doesn't follow links to
+// directories, so a link can't loop. Link targets are only checked as
+// strings, which doesn't account for other links along the way, so entries
+// under a link are refused and checkParent resolves the real directory
+// before anything is written or removed.
+
+// hasValidLink checks that the link target stays inside the current
+// directory, taken relative to the directory of the link itself
+func (f File) hasValidLink() bool {
+	if path.IsAbs(f.Link) || filepath.VolumeName(f.Link) != "" || strings.Contains(f.Link, `\`) {
+		return false
+	}
+	target := path.Join(path.Dir(f.Name), f.Link)
+	return target != "." && target != ".." && !strings.HasPrefix(target, "../")
+}
+
+// readLink returns the target of the symlink at the slash separated name
+// as a manifest Link. An absolute target inside the current directory is
+// made relative to the link.
+func readLink(name string) (string, error) {
+	linkPath := filepath.FromSlash(name)
+	target, err := os.Readlink(linkPath)
+	if err != nil {
+		return "", err
+	}
+	originalTarget := target
+	if filepath.IsAbs(target) {
+		absoluteLink, err := filepath.Abs(linkPath)
+		if err != nil {
+			return "", err
+		}
+		if target, err = filepath.Rel(filepath.Dir(absoluteLink), target); err != nil {
+			return "", err
+		}
+	}
+	link := File{Name: name, Link: filepath.ToSlash(target)}
+	if !link.hasValidLink() {
+		return "", fmt.Errorf("symlink to %s points outside of the repository", originalTarget)
+	}
+	return link.Link, nil
+}
+
+// skipThroughLinks leaves out the Files and Removed entries of repo that
+// are inside a directory the manifest makes a link. Written through the
+// link they could end up anywhere the link leads.
+func skipThroughLinks(repo *Repository, options UpdateOptions) {
+	links := map[string]bool{}
+	for _, rf := range repo.Files {
+		if len(rf.Link) > 0 {
+			links[rf.Name] = true
+		}
+	}
+	if len(links) == 0 {
+		return
+	}
+	var files []File
+	for _, rf := range repo.Files {
+		if link := linkedParent(rf.Name, links); len(link) > 0 {
+			fmt.Fprintf(options.Output, "Skipping %s: it is under the symlink %s\n", rf.Name, link)
+			options.Logger.Warn("unsafe Files entry", "file", rf.Name, "link", link)
+			continue
+		}
+		files = append(files, rf)
+	}
+	repo.Files = files
+	var removed []string
+	for _, name := range repo.Removed {
+		if link := linkedParent(name, links); len(link) > 0 {
+			fmt.Fprintf(options.Output, "Not removing %s: it is under the symlink %s\n", name, link)
+			options.Logger.Warn("unsafe Removed entry", "file", name, "link", link)
+			continue
+		}
+		removed = append(removed, name)
+	}
+	repo.Removed = removed
+}
+
+// linkedParent returns the first directory of the slash separated name
+// that is in links, or "" if there is none
+func linkedParent(name string, links map[string]bool) string {
+	for i := 0; i < len(name); i++ {
+		if name[i] == '/' && links[name[:i]] {
+			return name[:i]
+		}
+	}
+	return ""
+}
+
+// checkParent resolves the symlinks on the way to the directory of the
+// slash separated name and checks that it is still inside the current
+// directory. A directory that doesn't exist yet is checked from the part of
+// it that does.
+func checkParent(name string) error {
+	currentPath, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if currentPath, err = filepath.EvalSymlinks(currentPath); err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(filepath.Dir(filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	for {
+		resolved, resolveError := filepath.EvalSymlinks(dir)
+		if os.IsNotExist(resolveError) && filepath.Dir(dir) != dir {
+			dir = filepath.Dir(dir)
+			continue
+		}
+		if resolveError != nil {
+			return resolveError
+		}
+		relativePath, relError := filepath.Rel(currentPath, resolved)
+		if relError != nil || filepath.IsAbs(relativePath) || relativePath == ".." || strings.HasPrefix(relativePath, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("%s leads outside of the current directory through a symlink", name)
+		}
+		return nil
+	}
+}
+
+// linkMatches reports whether rf.Name already is a symlink to rf.Link
+func linkMatches(rf File) bool {
+	target, err := os.Readlink(filepath.FromSlash(rf.Name))
+	return err == nil && filepath.ToSlash(target) == rf.Link
+}
+
+// createLink replaces whatever is at rf.Name with a symlink to rf.Link. Like
+// a download, the link is made next to the file and renamed over it.
+func (d *downloader) createLink(rf File) error {
+	name := filepath.FromSlash(rf.Name)
+	if makeDirError := makeParentDir(rf.Name); makeDirError != nil {
+		return makeDirError
+	}
+	if info, statError := os.Lstat(name); statError == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", rf.Name)
+		}
+		// an old link is made again easily, a file may not be
+		if info.Mode().IsRegular() && len(d.BackupDir) > 0 {
+			if backupError := backupFile(d.BackupDir, rf.Name); backupError != nil {
+				return fmt.Errorf("unable to back up %s : %v", rf.Name, backupError)
+			}
+		}
+	}
+	tempName := name + ".tmp"
+	os.Remove(tempName)
+	if linkError := os.Symlink(filepath.FromSlash(rf.Link), tempName); linkError != nil {
+		return linkError
+	}
+	if renameError := os.Rename(tempName, name); renameError != nil {
+		os.Remove(tempName)
+		return renameError
+	}
+	return nil
+}
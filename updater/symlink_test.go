@@ -0,0 +1,150 @@
+package updater
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCreateRepositoryLinks(t *testing.T) {
+	dir := chdirTemp(t)
+	writeFile(t, filepath.Join("outside", "b.txt"), "b")
+	writeFile(t, filepath.Join("root", "mod", "data", "a.txt"), "a")
+	if err := os.Chdir("root"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("data", "a.txt"), filepath.Join("mod", "inside")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if err := os.Symlink(filepath.Join("..", "..", "outside", "b.txt"), filepath.Join("mod", "relative")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "outside"), filepath.Join("mod", "absolute")); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := CreateRepository([]string{"mod"}, CreateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]File{}
+	for _, rf := range repo.Files {
+		files[rf.Name] = rf
+	}
+	if link := files["mod/inside"].Link; link != "data/a.txt" {
+		t.Errorf("link inside the repository recorded as %q, want data/a.txt", link)
+	}
+	for _, name := range []string{"mod/relative", "mod/absolute"} {
+		if _, found := files[name]; found {
+			t.Errorf("link %s pointing outside of the repository was recorded", name)
+		}
+	}
+}
+
+func TestUpdateLinks(t *testing.T) {
+	dir := chdirTemp(t)
+	writeFile(t, filepath.Join("source", "data", "a.txt"), "a")
+	writeFile(t, filepath.Join("source", "x", "y", "l", "evil"), "evil")
+	hash, err := CalculateHash(strings.NewReader("a"), DefaultHashAlgo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evilHash, err := CalculateHash(strings.NewReader("evil"), DefaultHashAlgo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := &Repository{
+		DownloadRoot: filepath.Join(dir, "source"),
+		HashAlgo:     DefaultHashAlgo,
+		Files: []File{
+			{Name: "data/a.txt", Hash: hash},
+			{Name: "inside", Link: "data/a.txt"},
+			{Name: "outside", Link: "../evil"},
+			// each link stays inside on its own, together they lead out
+			{Name: "x/y/b", Link: ".."},
+			{Name: "x/y/l", Link: "b/../.."},
+			{Name: "x/y/l/evil", Hash: evilHash},
+		},
+	}
+	manifest := filepath.Join(dir, "updater.json")
+	if err := repo.Save(manifest); err != nil {
+		t.Fatal(err)
+	}
+	install := filepath.Join(dir, "install", "game")
+	if err := os.MkdirAll(install, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(install); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Update(context.Background(), UpdateOptions{RepoURL: manifest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target, err := os.Readlink("inside"); err != nil || target != filepath.FromSlash("data/a.txt") {
+		t.Errorf("link inside the repository is %q, %v", target, err)
+	}
+	if _, err := os.Lstat("outside"); err == nil {
+		t.Error("link pointing outside of the repository was created")
+	}
+	for _, name := range []string{filepath.Join(dir, "install", "evil"), filepath.Join(dir, "evil")} {
+		if _, err := os.Lstat(name); err == nil {
+			t.Errorf("file was written outside of the install directory to %s", name)
+		}
+	}
+}
+
+func TestCheckParent(t *testing.T) {
+	dir := chdirTemp(t)
+	if err := os.MkdirAll(filepath.Join("install", "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("data", filepath.Join("install", "in")); err != nil {
+		t.Skip("symlinks not supported:", err)
+	}
+	if err := os.Symlink(dir, filepath.Join("install", "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("install"); err != nil {
+		t.Fatal(err)
+	}
+	for name, valid := range map[string]bool{
+		"a.txt":           true,
+		"in/a.txt":        true,
+		"missing/a/b.txt": true,
+		"out/a.txt":       false,
+		"out/missing/a":   false,
+	} {
+		if err := checkParent(name); (err == nil) != valid {
+			t.Errorf("checkParent(%q) = %v, want valid %v", name, err, valid)
+		}
+	}
+}
+
+func TestSkipThroughLinks(t *testing.T) {
+	repo := &Repository{
+		Files: []File{
+			{Name: "a/link", Link: "b"},
+			{Name: "a/link/c", Hash: "1"},
+			{Name: "a/linked", Hash: "2"},
+			{Name: "a/b/c", Hash: "3"},
+		},
+		Removed: []string{"a/link/d", "a/e"},
+	}
+	options := UpdateOptions{}
+	options.setDefaults()
+	skipThroughLinks(repo, options)
+	var names []string
+	for _, rf := range repo.Files {
+		names = append(names, rf.Name)
+	}
+	if got := strings.Join(names, ","); got != "a/link,a/linked,a/b/c" {
+		t.Errorf("files %s left", got)
+	}
+	if got := strings.Join(repo.Removed, ","); got != "a/e" {
+		t.Errorf("removed %s left", got)
+	}
+}
@@ -0,0 +1,77 @@
+package updater
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A DownloadRoot containing placeholders is a template for the address of
+// each file instead of a directory the names are appended to, so that files
+// can be served from content addressed storage such as
+// https://cdn.example.com/{hash:0:2}/{hash}. The placeholders are
+//
+//	{name}            the name of the file in the manifest
+//	{hash}            the hash of the file
+//	{hash:start:end}  a part of the hash, either end can be left out
+//
+// The suffix of a compressed file is still appended to the address.
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// isTemplate reports whether the download root has placeholders
+func isTemplate(downloadRoot string) bool {
+	return placeholderPattern.MatchString(downloadRoot)
+}
+
+// checkTemplate reports the first placeholder of downloadRoot that is not
+// one of the known ones
+func checkTemplate(downloadRoot string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(downloadRoot, -1) {
+		if _, err := expandPlaceholder(placeholder, File{Name: "name", Hash: strings.Repeat("0", 128)}); err != nil {
+			return fmt.Errorf("invalid download root %q: %v", downloadRoot, err)
+		}
+	}
+	return nil
+}
+
+// downloadURL returns the address of rf under downloadRoot
+func downloadURL(downloadRoot string, rf File) (string, error) {
+	if !isTemplate(downloadRoot) {
+		return downloadRoot + rf.Name, nil
+	}
+	var expandError error
+	expanded := placeholderPattern.ReplaceAllStringFunc(downloadRoot, func(placeholder string) string {
+		value, err := expandPlaceholder(placeholder, rf)
+		if err != nil && expandError == nil {
+			expandError = err
+		}
+		return value
+	})
+	return expanded, expandError
+}
+
+func expandPlaceholder(placeholder string, rf File) (string, error) {
+	fields := strings.Split(strings.Trim(placeholder, "{}"), ":")
+	switch {
+	case len(fields) == 1 && fields[0] == "name":
+		return rf.Name, nil
+	case len(fields) == 1 && fields[0] == "hash":
+		return rf.Hash, nil
+	case len(fields) == 3 && fields[0] == "hash":
+		start, end := 0, len(rf.Hash)
+		var startError, endError error
+		if len(fields[1]) > 0 {
+			start, startError = strconv.Atoi(fields[1])
+		}
+		if len(fields[2]) > 0 {
+			end, endError = strconv.Atoi(fields[2])
+		}
+		if startError != nil || endError != nil || start < 0 || start > end || end > len(rf.Hash) {
+			return "", fmt.Errorf("placeholder %s doesn't fit a hash of %d characters", placeholder, len(rf.Hash))
+		}
+		return rf.Hash[start:end], nil
+	}
+	return "", fmt.Errorf("unknown placeholder %s, expected {name}, {hash} or {hash:start:end}", placeholder)
+}
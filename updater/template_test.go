@@ -0,0 +1,41 @@
+package updater
+
+import "testing"
+
+func TestDownloadURL(t *testing.T) {
+	rf := File{Name: "mods/a.pbo", Hash: "86f7e437faa5a7fce15d1ddcb9eaeaea377667b8"}
+	for _, test := range []struct {
+		downloadRoot string
+		want         string
+	}{
+		{"https://example.com/repo/", "https://example.com/repo/mods/a.pbo"},
+		{"https://cdn.example.com/{hash}", "https://cdn.example.com/86f7e437faa5a7fce15d1ddcb9eaeaea377667b8"},
+		{"https://cdn.example.com/{hash:0:2}/{hash}", "https://cdn.example.com/86/86f7e437faa5a7fce15d1ddcb9eaeaea377667b8"},
+		{"https://cdn.example.com/{hash::4}/{hash:36:}", "https://cdn.example.com/86f7/67b8"},
+		{"https://cdn.example.com/{hash}/{name}", "https://cdn.example.com/86f7e437faa5a7fce15d1ddcb9eaeaea377667b8/mods/a.pbo"},
+	} {
+		got, err := downloadURL(test.downloadRoot, rf)
+		if err != nil || got != test.want {
+			t.Errorf("downloadURL(%q) = %q, %v, want %q", test.downloadRoot, got, err, test.want)
+		}
+	}
+}
+
+func TestCheckTemplate(t *testing.T) {
+	for downloadRoot, valid := range map[string]bool{
+		"https://example.com/repo/":            true,
+		"https://cdn.example.com/{hash}":       true,
+		"https://cdn.example.com/{name}":       true,
+		"https://cdn.example.com/{hash:2:}":    true,
+		"https://cdn.example.com/{size}":       false,
+		"https://cdn.example.com/{hash:2}":     false,
+		"https://cdn.example.com/{hash:4:2}":   false,
+		"https://cdn.example.com/{hash:x:}":    false,
+		"https://cdn.example.com/{hash:-1:}":   false,
+		"https://cdn.example.com/{hash:0:999}": false,
+	} {
+		if err := checkTemplate(downloadRoot); (err == nil) != valid {
+			t.Errorf("checkTemplate(%q) = %v, want valid %v", downloadRoot, err, valid)
+		}
+	}
+}
@@ -0,0 +1,1135 @@
+package updater
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheFileName is the local file remembering the hashes of files from
+// earlier runs
+const CacheFileName = ".updater-cache.json"
+
+// ManifestFileName is the usual local name of a manifest, it is never pruned
+const ManifestFileName = "updater.json"
+
+// pendingSaveInterval is how often the cache is saved during downloads, see
+// hashCache.Pending
+const pendingSaveInterval = 2 * time.Second
+
+// DefaultTimeout is used when UpdateOptions.Timeout is not set
+const DefaultTimeout = 30 * time.Second
+
+// DefaultMaxManifestSize is used when UpdateOptions.MaxManifestSize is not
+// set, enough for a manifest of some hundred thousand files
+const DefaultMaxManifestSize = 32 << 20
+
+// UpdateOptions configures Update and FetchRepository
+type UpdateOptions struct {
+	// address of the manifest, separate fallback addresses with commas
+	RepoURL string
+	// number of files downloaded or hashed in parallel
+	Concurrency int
+	// how many times a failed download is retried before giving up
+	Retries int
+	// only report what would be downloaded and removed
+	DryRun bool
+	// remove files that are not part of the repository
+	Prune bool
+	// with Prune, only list the files that would be pruned while the rest
+	// of the update runs normally. They go to Report.WouldPrune
+	PruneDryRun bool
+	// move the pruned files under TrashDirName instead of deleting them
+	PruneToTrash bool
+	// called with the files about to be pruned, they are only removed if it
+	// returns true. nil prunes without asking
+	ConfirmPrune func(files []string) bool
+	// set the modification time of downloaded files from the manifest
+	PreserveTimes bool
+	// always download whole files instead of resuming partial downloads
+	NoResume bool
+	// a Bundle of the manifest is downloaded when at least this many of its
+	// files are needed, DefaultBundleThreshold if not set. Negative never
+	// uses bundles
+	BundleThreshold int
+	// only check the files against the manifest, never download or prune
+	Verify bool
+	// download every file again without comparing hashes, for a clean
+	// install. Ignored with Verify
+	Force bool
+	// leave alone the files whose content last changed in the repository
+	// at or before this time, see File.Changed, even when the local copy
+	// differs, such as an intentional local override of an old file.
+	// Missing files and files of unknown age are still downloaded. Zero
+	// checks all the files. Ignored with Verify and Force
+	ChangedSince time.Time
+	// write the manifest as it was fetched here once it has been checked,
+	// so the run can be repeated against the copy. The included manifests
+	// are not saved, and relative download roots resolve next to the copy.
+	// The full manifest is fetched even when a delta could be used
+	SaveManifest string
+	// ask the server about the files to download with HEAD requests first,
+	// failing the ones it doesn't have and filling in the sizes the
+	// manifest lacks. See head.go
+	HeadCheck bool
+	// only check and download the manifest entry of this name, such as a
+	// file a player reported broken. Nothing is pruned, and the update
+	// fails if the manifest has no such entry
+	File string
+	// don't download the optional files of the manifest that are not
+	// installed, see File.Optional. The ones already installed are still
+	// kept up to date
+	SkipOptional bool
+	// hash every file again once the update is done, reporting the ones
+	// that still don't match in Report.Unverified. Ignored with Verify
+	VerifyAfter bool
+	// leave files that already match out of the output
+	HideUnchanged bool
+	// save the files about to be replaced under BackupDirName, see Rollback
+	Backup bool
+	// when not empty, only files matching one of these patterns are
+	// checked, downloaded or pruned. See MatchGlob
+	Include []string
+	// files matching one of these patterns are left alone, even if they are
+	// also included
+	Exclude []string
+	// files and directories matching one of these patterns are never
+	// pruned, along with those of Repository.PruneExclude. The running
+	// executable, CacheFile, StateFile and any ManifestFileName are always kept
+	PruneExclude []string
+	// when set, the manifest is only used if its detached signature was made
+	// with the matching private key
+	VerifyKey ed25519.PublicKey
+	// where the hashes of local files are cached between runs
+	CacheFile string
+	// checks the files whose hash matches once more, both the local copies
+	// and the downloads. A file it rejects is downloaded again, and a
+	// download it rejects fails. nil only checks the hash
+	Verifier Verifier
+	// runs the Repository.PostDownload commands for the files downloaded,
+	// a command that fails counts as a failed file. nil only tells that
+	// the repository has commands, as they come from the server
+	PostDownload func(command string) error
+	// stop the downloads once this many files have failed, as the server
+	// is then likely down or misconfigured. 0 tries every file
+	MaxErrors int
+	// records how the runs ended, StateFileName if not set
+	StateFile string
+	// locked for the duration of the run, LockFileName if not set
+	LockFile string
+	// called after the manifest has been fetched but before any file is
+	// checked, e.g. to close the game. An error aborts the update. Not
+	// called for DryRun or Verify
+	PreRun func() error
+	// how long a request may wait for the server before it is given up,
+	// DefaultTimeout if not set
+	Timeout time.Duration
+	// sent with every request, DefaultUserAgent() if not set
+	UserAgent string
+	// extra headers sent with every request
+	Header http.Header
+	// "user:password" for HTTP basic auth, sent to the manifest address,
+	// the download root and the mirrors alike
+	BasicAuth string
+	// sent as a bearer token instead of BasicAuth when set
+	Token string
+	// total download rate in bytes per second over all concurrent
+	// downloads, 0 doesn't limit it
+	MaxRate int64
+	// files larger than this many bytes are not downloaded but counted as
+	// failed, going by the manifest or the server. 0 allows any size
+	MaxFileSize int64
+	// manifests, their checksums and signatures larger than this many bytes
+	// are refused instead of read into memory
+	MaxManifestSize int64
+	// treat redirects as errors instead of following them
+	NoRedirect bool
+	// proxy for all requests such as http://host:port or socks5://host:port,
+	// see ParseProxy. If not set, HTTP_PROXY, HTTPS_PROXY and NO_PROXY are
+	// used
+	Proxy string
+	// SHA-256 hashes of the public keys accepted from HTTPS servers, see
+	// ParsePin. Mirrors on other hosts need their own keys listed. Any key
+	// is accepted if empty
+	PinSHA256 [][]byte
+	// only connect over IPv4, for networks with a broken IPv6 route
+	ForceIPv4 bool
+	// "host:port" of a DNS server used instead of the system resolver, see
+	// DNSServerAddress
+	DNSServer string
+	// used for all requests, NewHTTPClient(Timeout) with Proxy, ForceIPv4,
+	// DNSServer and PinSHA256 if not set. A custom client needs to handle
+	// file:// itself for local repositories and ignores those settings
+	Client *http.Client
+	// receives the human readable progress of the run, nil discards it
+	Output io.Writer
+	// receives diagnostics for bug reports: requests, responses and hash
+	// comparisons at debug level, failures as warnings. nil discards them
+	Logger *slog.Logger
+	// redraw the download progress in place instead of printing a new line
+	// every 10 percent. Only makes sense when Output is a terminal
+	Terminal bool
+	// with Terminal, show the downloaded files on the progress line instead
+	// of a line for each. Failures are still printed on their own
+	Compact bool
+	// color the status of each file with ANSI codes: OK green, downloads
+	// yellow and failures red. Only makes sense when Output is a terminal
+	Color bool
+}
+
+func (o *UpdateOptions) setDefaults() {
+	if o.Concurrency < 1 {
+		o.Concurrency = 1
+	}
+	if o.BundleThreshold == 0 {
+		o.BundleThreshold = DefaultBundleThreshold
+	}
+	if len(o.CacheFile) == 0 {
+		o.CacheFile = CacheFileName
+	}
+	if len(o.LockFile) == 0 {
+		o.LockFile = LockFileName
+	}
+	if len(o.StateFile) == 0 {
+		o.StateFile = StateFileName
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultTimeout
+	}
+	if o.MaxManifestSize <= 0 {
+		o.MaxManifestSize = DefaultMaxManifestSize
+	}
+	if len(o.UserAgent) == 0 {
+		o.UserAgent = DefaultUserAgent()
+	}
+	if o.Client == nil {
+		o.Client = newHTTPClient(*o)
+	}
+	if o.NoRedirect {
+		// a copy so that a client passed in by the caller isn't changed
+		client := *o.Client
+		client.CheckRedirect = noRedirects
+		o.Client = &client
+	}
+	if o.Output == nil {
+		o.Output = ioutil.Discard
+	}
+	if o.Logger == nil {
+		o.Logger = slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	}
+}
+
+// delay before the first retry, doubled after every failed attempt
+const retryBackoff = time.Second
+
+// newRequest creates a GET request carrying the configured headers
+func (o *UpdateOptions) newRequest(ctx context.Context, address string) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, "GET", address, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("User-Agent", o.UserAgent)
+	if len(o.Token) > 0 {
+		request.Header.Set("Authorization", "Bearer "+o.Token)
+	} else if len(o.BasicAuth) > 0 {
+		username, password, _ := strings.Cut(o.BasicAuth, ":")
+		request.SetBasicAuth(username, password)
+	}
+	// a User-Agent in Header replaces the default one
+	for key, values := range o.Header {
+		request.Header[http.CanonicalHeaderKey(key)] = values
+	}
+	return request, nil
+}
+
+// inScope reports whether name passes the Include and Exclude patterns
+func (o *UpdateOptions) inScope(name string) bool {
+	if matchesAny(o.Exclude, name) {
+		return false
+	}
+	return len(o.Include) == 0 || matchesAny(o.Include, name)
+}
+
+// leavesAlone reports whether rf is older than ChangedSince, so a local copy
+// is kept even if it differs
+func (o *UpdateOptions) leavesAlone(rf File) bool {
+	return !o.ChangedSince.IsZero() && !o.Verify && !o.Force && rf.Changed > 0 && rf.Changed <= o.ChangedSince.Unix()
+}
+
+// go doesn't have "str in []string" check built in
+func stringInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return true
+		}
+	}
+	return false
+}
+
+// Update brings the current directory up to date with the repository. The
+// returned report is never nil, even when the error is. The error is only
+// set when the run couldn't go on: another run holds the lock, the
+// repository could not be fetched, options.File is not in it,
+// options.PreRun failed, there is not enough disk space or the disk filled
+// up, options.MaxErrors files failed, or ctx was cancelled. Failures of
+// single files are listed in the report.
+func Update(ctx context.Context, options UpdateOptions) (report *Report, err error) {
+	options.setDefaults()
+	out := options.Output
+	report = newReport()
+	started := time.Now()
+	defer func() {
+		report.Elapsed = time.Since(started)
+	}()
+
+	unlock, lockError := Lock(options.LockFile)
+	if lockError != nil {
+		return report, lockError
+	}
+	defer unlock()
+
+	fmt.Fprintln(out, "Repository:", options.RepoURL)
+	// only a run that may change files is remembered
+	state := loadUpdateState(options.StateFile)
+	state.Print(out)
+	var manifestFiles int
+	if !options.DryRun && !options.Verify {
+		run := &RunState{Started: started, Repository: options.RepoURL}
+		state.LastRun = run
+		saveState := func() {
+			if saveError := state.Save(); saveError != nil {
+				options.Logger.Warn("saving state failed", "path", options.StateFile, "error", saveError)
+			}
+		}
+		saveState()
+		defer func() {
+			run.Finished = time.Now()
+			run.ManifestVersion = report.ManifestVersion
+			run.Files = manifestFiles
+			run.Errors = report.failedFiles()
+			run.Interrupted = report.Interrupted
+			if err != nil {
+				run.Error = err.Error()
+			}
+			if err == nil && run.Errors == 0 && len(options.Include) == 0 && len(options.Exclude) == 0 && len(options.File) == 0 {
+				state.LastSuccess = run
+			}
+			saveState()
+		}()
+	}
+
+	// only the files changed since the installed release are checked when
+	// the repository publishes them, see delta.go
+	var repo *Repository
+	var fetchError error
+	if installed, found := loadHashCache(options.CacheFile).InstalledRelease(options.RepoURL); found && !options.Verify && !options.Force && len(options.SaveManifest) == 0 && len(options.File) == 0 {
+		if repo, fetchError = fetchDelta(ctx, options, installed); fetchError != nil {
+			report.Interrupted = true
+			return report, fetchError
+		}
+	}
+	isDelta := repo != nil
+	if !isDelta {
+		repo, fetchError = FetchRepository(ctx, options)
+	}
+	if fetchError != nil {
+		report.Interrupted = ctx.Err() != nil
+		options.Logger.Error("fetching repository failed", "error", fetchError)
+		return report, fetchError
+	}
+	if len(options.File) > 0 {
+		name := normalizeName(options.File)
+		var entry []File
+		for _, rf := range repo.Files {
+			if rf.Name == name {
+				entry = append(entry, rf)
+			}
+		}
+		if len(entry) == 0 {
+			return report, fmt.Errorf("%s is not part of the repository", name)
+		}
+		repo.Files = entry
+		options.Prune = false
+	}
+	listOfRepositoryFiles := repo.Files
+	manifestFiles = len(repo.Files)
+	report.Run = repo.Run
+	report.ManifestVersion = max(repo.Version, 1)
+
+	if options.PreRun != nil && !options.DryRun && !options.Verify {
+		if preRunError := options.PreRun(); preRunError != nil {
+			return report, fmt.Errorf("pre-update command failed: %v", preRunError)
+		}
+	}
+
+	var downloadFiles []File
+	// symlinks that are missing or point somewhere else
+	var linkFiles []File
+	downloadErrors := 0
+	// optional files that fail don't make the install incomplete, so they
+	// are reported apart and not counted as errors
+	optional := map[string]bool{}
+	failDownload := func(fileError FileError) {
+		if optional[fileError.Name] {
+			report.OptionalFailed = append(report.OptionalFailed, fileError)
+			return
+		}
+		report.Failed = append(report.Failed, fileError)
+		downloadErrors++
+	}
+
+	cache := loadHashCache(options.CacheFile)
+	if !options.DryRun {
+		defer func() {
+			if saveError := cache.Save(); saveError != nil {
+				fmt.Fprintln(out, "Unable to save hash cache:", saveError)
+				options.Logger.Warn("saving hash cache failed", "path", options.CacheFile, "error", saveError)
+			}
+		}()
+	}
+
+	var directoriesToPrune []string
+
+	missingStatus, changedStatus, skipStatus := "Download", "Download (Changed)", "Skip:"
+	if options.Verify {
+		missingStatus, changedStatus, skipStatus = "MISSING", "CHANGED", "ERROR:"
+	}
+	okStatus := colored(options.Color, colorOK, "OK")
+	missingStatus = colored(options.Color, colorChanged, missingStatus)
+	changedStatus = colored(options.Color, colorChanged, changedStatus)
+	skipStatus = colored(options.Color, colorFailed, skipStatus)
+	force := options.Force && !options.Verify
+
+	fmt.Fprintln(out, "")
+	if force {
+		fmt.Fprintln(out, "FORCED FULL DOWNLOAD: every file is downloaded again, even the ones that already match")
+		fmt.Fprintln(out, "")
+	}
+
+	// check existing files and their checksum. The files are hashed in
+	// parallel ahead of the loop, which still goes through them in order
+	hashes := hashFiles(ctx, cache, listOfRepositoryFiles, func(rf File) bool {
+		return !force && len(rf.Link) == 0 && rf.HasValidPath() && options.inScope(rf.Name) && (options.Verify || !cache.IsPending(rf))
+	}, options.Concurrency)
+	for i, rf := range listOfRepositoryFiles {
+		if ctx.Err() != nil {
+			report.Interrupted = true
+			return report, ctx.Err()
+		}
+
+		if !rf.HasValidPath() {
+			// invalid path, ignore
+			continue
+		}
+		if !options.inScope(rf.Name) {
+			continue
+		}
+
+		// the name goes out before hashing so a big file shows what is
+		// taking so long. Hiding unchanged files has to wait for the hash
+		if !options.HideUnchanged {
+			fmt.Fprint(out, rf.Name+" : ")
+		}
+		printStatus := func(status ...interface{}) {
+			if options.HideUnchanged {
+				fmt.Fprint(out, rf.Name+" : ")
+			}
+			fmt.Fprintln(out, status...)
+		}
+
+		// collect directory name to list of directories for pruning
+		pathParts := strings.Split(rf.Name, "/")
+		if !stringInSlice(pathParts[0], directoriesToPrune) {
+			directoriesToPrune = append(directoriesToPrune, pathParts[0])
+		}
+
+		if rf.Optional {
+			optional[rf.Name] = true
+			report.Optional = append(report.Optional, rf.Name)
+			if options.SkipOptional || options.Verify {
+				if _, statError := os.Lstat(filepath.FromSlash(rf.Name)); os.IsNotExist(statError) {
+					report.OptionalMissing = append(report.OptionalMissing, rf.Name)
+					if options.Verify {
+						printStatus("Not installed (optional)")
+					} else {
+						printStatus("Skipped (optional)")
+					}
+					continue
+				}
+			}
+		}
+
+		if force {
+			if len(rf.Link) > 0 {
+				linkFiles = append(linkFiles, rf)
+			} else {
+				downloadFiles = append(downloadFiles, rf)
+			}
+			if _, statError := os.Lstat(filepath.FromSlash(rf.Name)); os.IsNotExist(statError) {
+				report.Missing = append(report.Missing, rf.Name)
+				printStatus(missingStatus)
+			} else {
+				report.Changed = append(report.Changed, rf.Name)
+				printStatus(colored(options.Color, colorChanged, "Download (Forced)"))
+			}
+			continue
+		}
+
+		if len(rf.Link) > 0 {
+			if linkMatches(rf) {
+				report.Unchanged = append(report.Unchanged, rf.Name)
+				if !options.HideUnchanged {
+					fmt.Fprintln(out, okStatus)
+				}
+			} else if _, statError := os.Lstat(filepath.FromSlash(rf.Name)); os.IsNotExist(statError) {
+				linkFiles = append(linkFiles, rf)
+				report.Missing = append(report.Missing, rf.Name)
+				printStatus(missingStatus)
+			} else {
+				linkFiles = append(linkFiles, rf)
+				report.Changed = append(report.Changed, rf.Name)
+				printStatus(changedStatus)
+			}
+			continue
+		}
+
+		// the local copy is still the one that was being replaced, there is
+		// no need to hash it to know that
+		if _, statError := os.Stat(rf.Name); statError == nil && cache.IsPending(rf) && !options.Verify {
+			downloadFiles = append(downloadFiles, rf)
+			report.Changed = append(report.Changed, rf.Name)
+			printStatus(colored(options.Color, colorChanged, "Download (Interrupted)"))
+			continue
+		}
+
+		var existingHash string
+		var hashError error
+		if hashes[i] != nil {
+			<-hashes[i].done
+			existingHash, hashError = hashes[i].hash, hashes[i].err
+		} else {
+			existingHash, hashError = cachedHash(cache, rf)
+		}
+		options.Logger.Debug("compared hash", "file", rf.Name, "local", existingHash, "expected", rf.Hash, "error", hashError)
+
+		if os.IsNotExist(hashError) {
+			downloadFiles = append(downloadFiles, rf)
+			report.Missing = append(report.Missing, rf.Name)
+			printStatus(missingStatus)
+			continue
+		} else if hashError != nil {
+			report.Skipped = append(report.Skipped, FileError{rf.Name, hashError.Error()})
+			options.Logger.Warn("checking file failed", "file", rf.Name, "error", hashError)
+			printStatus(skipStatus, hashError)
+			continue
+		}
+
+		accepted := true
+		if existingHash == rf.Hash {
+			var verifyError error
+			if accepted, verifyError = options.verify(filepath.FromSlash(rf.Name), rf); verifyError != nil {
+				report.Skipped = append(report.Skipped, FileError{rf.Name, verifyError.Error()})
+				options.Logger.Warn("verifying file failed", "file", rf.Name, "error", verifyError)
+				printStatus(skipStatus, verifyError)
+				continue
+			}
+		}
+
+		if existingHash == rf.Hash && accepted {
+			// the content is right but the permissions may have changed
+			if !options.DryRun && !options.Verify {
+				if modeError := applyMode(rf.Name, rf); modeError != nil {
+					options.Logger.Warn("setting file mode failed", "file", rf.Name, "mode", rf.Mode, "error", modeError)
+				}
+			}
+			report.Unchanged = append(report.Unchanged, rf.Name)
+			if !options.HideUnchanged {
+				fmt.Fprintln(out, okStatus)
+			}
+		} else if accepted && options.leavesAlone(rf) {
+			report.Kept = append(report.Kept, rf.Name)
+			printStatus(colored(options.Color, colorChanged, "Kept (not changed since "+options.ChangedSince.Format("2006-01-02 15:04")+")"))
+		} else {
+			downloadFiles = append(downloadFiles, rf)
+			report.Changed = append(report.Changed, rf.Name)
+			printStatus(changedStatus)
+		}
+	}
+
+	if options.Verify {
+		return report, nil
+	}
+
+	if options.Prune {
+		fmt.Fprintln(out, "")
+		fmt.Fprintln(out, "Pruning non-repository files")
+		options.PruneExclude = append(append([]string{}, options.PruneExclude...), repo.PruneExclude...)
+		unlisted := removedFiles(repo)
+		if !isDelta {
+			unlisted = findUnlistedFiles(directoriesToPrune, repo.Managed, listOfRepositoryFiles, options)
+		}
+		pruned := pruneFiles(unlisted, options)
+		if options.PruneDryRun && !options.DryRun {
+			report.WouldPrune = append(report.WouldPrune, pruned...)
+		} else {
+			report.Pruned = append(report.Pruned, pruned...)
+		}
+	}
+
+	if options.DryRun {
+		return report, nil
+	}
+
+	// download files that are missing or failed checksum in the first loop.
+	// workers report back through results so that each file gets printed
+	// on a single line without interleaving
+	fmt.Fprintln(out, "")
+	if options.HeadCheck && len(downloadFiles) > 0 {
+		fmt.Fprintf(out, "Checking %d files on the server\n", len(downloadFiles))
+		var missing []FileError
+		downloadFiles, missing = headCheck(ctx, options, append([]string{repo.DownloadRoot}, repo.Mirrors...), downloadFiles)
+		for _, fileError := range missing {
+			failDownload(fileError)
+		}
+	}
+	if options.MaxFileSize > 0 {
+		var allowedFiles []File
+		for _, rf := range downloadFiles {
+			if rf.Size > options.MaxFileSize {
+				sizeError := fileTooLarge(rf.Size, options.MaxFileSize)
+				fmt.Fprintln(out, "Skipping", rf.Name, ":", sizeError)
+				options.Logger.Warn("file too large", "file", rf.Name, "size", rf.Size, "limit", options.MaxFileSize)
+				failDownload(FileError{rf.Name, sizeError.Error()})
+				continue
+			}
+			allowedFiles = append(allowedFiles, rf)
+		}
+		downloadFiles = allowedFiles
+	}
+	var totalSize int64
+	unknownSizes := 0
+	for _, rf := range downloadFiles {
+		if rf.Size > 0 {
+			totalSize += rf.Size
+		} else {
+			unknownSizes++
+		}
+	}
+	if len(downloadFiles) > 0 {
+		if unknownSizes > 0 {
+			fmt.Fprintf(out, "Need to download %d files (%s, size of %d files unknown)\n", len(downloadFiles), FormatBytes(totalSize), unknownSizes)
+		} else {
+			fmt.Fprintf(out, "Need to download %d files (%s)\n", len(downloadFiles), FormatBytes(totalSize))
+		}
+	}
+	// running out of space halfway leaves the install partly updated, so
+	// give up before downloading anything. Files of unknown size can't be
+	// accounted for
+	if available, spaceError := freeSpace("."); spaceError == nil && uint64(totalSize) > available {
+		options.Logger.Error("not enough disk space", "needed", totalSize, "available", available)
+		return report, fmt.Errorf("not enough disk space, need %s but only %s is available", FormatBytes(totalSize), FormatBytes(int64(available)))
+	}
+
+	downloadCtx, cancelDownloads := context.WithCancel(ctx)
+	defer cancelDownloads()
+	d := downloader{
+		Context:       downloadCtx,
+		DownloadRoots: append([]string{repo.DownloadRoot}, repo.Mirrors...),
+		Options:       options,
+		Cache:         cache,
+		Progress:      newDownloadProgress(out, options.Terminal, options.Color, totalSize),
+		cancel:        cancelDownloads,
+	}
+	if options.MaxRate > 0 {
+		d.Limiter = newRateLimiter(options.MaxRate)
+	}
+	if options.Compact {
+		d.Progress.ShowFiles(len(downloadFiles) + len(linkFiles))
+	}
+	if options.Backup && len(report.Changed) > 0 {
+		d.BackupDir = newBackupSet()
+		fmt.Fprintln(out, "Saving the replaced files to", d.BackupDir)
+	}
+	// if the run gets killed, the next one knows which files were left
+	// halfway without hashing them
+	cache.MarkPending(downloadFiles)
+	if saveError := cache.Save(); saveError != nil {
+		options.Logger.Warn("saving hash cache failed", "path", options.CacheFile, "error", saveError)
+	}
+	lastSave := time.Now()
+	for _, rf := range linkFiles {
+		if linkError := d.createLink(rf); linkError != nil {
+			d.Progress.FileDone("Linking", rf.Name, linkError)
+			options.Logger.Warn("creating symlink failed", "file", rf.Name, "link", rf.Link, "error", linkError)
+			failDownload(FileError{rf.Name, linkError.Error()})
+			continue
+		}
+		d.Progress.FileDone("Linking", rf.Name+" -> "+rf.Link, nil)
+		report.Downloaded = append(report.Downloaded, rf.Name)
+	}
+	if len(repo.Bundles) > 0 {
+		var installed []File
+		installed, downloadFiles = d.downloadBundles(repo.Bundles, downloadFiles, options.BundleThreshold)
+		for _, rf := range installed {
+			report.Downloaded = append(report.Downloaded, rf.Name)
+		}
+	}
+	jobs := make(chan File)
+	results := make(chan downloadResult)
+	var workers sync.WaitGroup
+	for i := 0; i < options.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for rf := range jobs {
+				results <- downloadResult{rf, d.downloadWithRetries(rf)}
+			}
+		}()
+	}
+	go func() {
+	feed:
+		for _, rf := range downloadFiles {
+			if downloadCtx.Err() != nil {
+				break
+			}
+			select {
+			case jobs <- rf:
+			case <-downloadCtx.Done():
+				break feed
+			}
+		}
+		close(jobs)
+		workers.Wait()
+		close(results)
+	}()
+
+	finished := 0
+	tooManyErrors := false
+	for result := range results {
+		// downloads cut short by a full disk are left for the next run
+		if result.Err != nil && d.stoppedByDiskFull() && ctx.Err() == nil && !isDiskFull(result.Err) {
+			continue
+		}
+		// as are the ones cut short by giving up
+		if result.Err != nil && tooManyErrors && ctx.Err() == nil {
+			continue
+		}
+		finished++
+		if result.Err != nil {
+			d.Progress.FileDone("Downloading", result.File.Name, result.Err)
+			options.Logger.Warn("download failed", "file", result.File.Name, "error", result.Err)
+			failDownload(FileError{result.File.Name, result.Err.Error()})
+			// this many files failing is more likely the server than the files
+			if options.MaxErrors > 0 && downloadErrors >= options.MaxErrors && !tooManyErrors {
+				tooManyErrors = true
+				d.Progress.Println(fmt.Sprintf("Aborting after %d errors, the server may be down", downloadErrors))
+				options.Logger.Error("too many errors, stopping the downloads", "errors", downloadErrors, "limit", options.MaxErrors)
+				cancelDownloads()
+			}
+		} else {
+			d.Progress.FileDone("Downloading", result.File.Name, nil)
+			report.Downloaded = append(report.Downloaded, result.File.Name)
+		}
+		// keep the finished files from being downloaded again after a crash
+		if time.Since(lastSave) > pendingSaveInterval {
+			cache.Save()
+			lastSave = time.Now()
+		}
+	}
+	report.Errors = downloadErrors
+	report.DownloadedBytes = atomic.LoadInt64(&d.BytesWritten)
+	d.Progress.Finish()
+	options.Logger.Info("update finished", "downloaded", len(report.Downloaded), "failed", len(report.Failed), "bytes", report.DownloadedBytes)
+
+	if ctx.Err() != nil {
+		report.Interrupted = true
+		return report, ctx.Err()
+	}
+	if d.stoppedByDiskFull() {
+		return report, fmt.Errorf("%w, %d files were not downloaded", ErrDiskFull, len(downloadFiles)-finished)
+	}
+	if tooManyErrors {
+		return report, fmt.Errorf("%w (%d), %d files were not downloaded", ErrTooManyErrors, downloadErrors, len(downloadFiles)-finished)
+	}
+	if options.VerifyAfter {
+		// the kept files are known not to match, and the optional ones
+		// left out or failed not to be there
+		kept := map[string]bool{}
+		for _, name := range report.Kept {
+			kept[name] = true
+		}
+		for _, name := range report.OptionalMissing {
+			kept[name] = true
+		}
+		for _, fileError := range report.OptionalFailed {
+			kept[fileError.Name] = true
+		}
+		var expected []File
+		for _, rf := range listOfRepositoryFiles {
+			if !kept[rf.Name] {
+				expected = append(expected, rf)
+			}
+		}
+		report.Unverified = verifyInstall(ctx, cache, expected, options)
+		if ctx.Err() != nil {
+			report.Interrupted = true
+			return report, ctx.Err()
+		}
+	}
+	if len(repo.PostDownload) > 0 {
+		unverified := map[string]bool{}
+		for _, fileError := range report.Unverified {
+			unverified[fileError.Name] = true
+		}
+		var verified []string
+		for _, name := range report.Downloaded {
+			if !unverified[name] {
+				verified = append(verified, name)
+			}
+		}
+		for _, commandError := range runPostDownload(ctx, repo, verified, options) {
+			failDownload(commandError)
+		}
+		report.Errors = downloadErrors
+		if ctx.Err() != nil {
+			report.Interrupted = true
+			return report, ctx.Err()
+		}
+	}
+	// the next delta can only start from here if every file is in place,
+	// or a later run without SkipOptional wouldn't get the optional ones
+	if downloadErrors == 0 && len(report.Skipped) == 0 && len(report.Unverified) == 0 && len(report.OptionalMissing) == 0 && len(report.OptionalFailed) == 0 && len(options.Include) == 0 && len(options.Exclude) == 0 && len(options.File) == 0 {
+		cache.SetInstalledRelease(options.RepoURL, installedRelease{repo.Release, repo.manifestURL, repo.Deltas})
+	}
+	return report, nil
+}
+
+// fileTooLarge is the error for a file over UpdateOptions.MaxFileSize
+func fileTooLarge(size int64, limit int64) error {
+	return fmt.Errorf("%s is larger than the limit of %s", FormatBytes(size), FormatBytes(limit))
+}
+
+// pruneFiles removes the files that are not part of the repository, found
+// by findUnlistedFiles or listed as removed by a delta, and returns the
+// files that were removed. Directories will not be removed.
+// options.ConfirmPrune is asked first, and with options.DryRun or
+// options.PruneDryRun the files are only listed. With options.PruneToTrash
+// they are moved to the trash instead.
+func pruneFiles(unlisted []string, options UpdateOptions) []string {
+	out := options.Output
+	protected := protectedFiles(options)
+	var candidates []string
+	for _, candidate := range unlisted {
+		// never touch files outside of what the user asked to update
+		if !options.inScope(candidate) {
+			continue
+		}
+		if isProtected(candidate, protected, options.PruneExclude) {
+			fmt.Fprintln(out, "Keeping", candidate, ": excluded from pruning")
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	if options.DryRun || options.PruneDryRun {
+		for _, candidate := range candidates {
+			fmt.Fprintln(out, "Would remove", candidate)
+		}
+		return candidates
+	}
+
+	if options.ConfirmPrune != nil && !options.ConfirmPrune(candidates) {
+		fmt.Fprintln(out, "Not removing anything")
+		return nil
+	}
+
+	var trashDir string
+	if options.PruneToTrash {
+		trashDir = filepath.Join(TrashDirName, time.Now().Format(backupSetFormat))
+	}
+	var removed []string
+	for _, candidate := range candidates {
+		if parentError := checkParent(candidate); parentError != nil {
+			fmt.Fprintln(out, "Not removing", candidate, ":", parentError)
+			options.Logger.Warn("pruning failed", "file", candidate, "error", parentError)
+			continue
+		}
+		if len(trashDir) > 0 {
+			target, trashError := trashFile(trashDir, candidate)
+			if trashError != nil {
+				fmt.Fprintln(out, "Unable to move", candidate, "to the trash :", trashError)
+				options.Logger.Warn("pruning failed", "file", candidate, "error", trashError)
+				continue
+			}
+			fmt.Fprintln(out, "Moved", candidate, "to", filepath.ToSlash(target))
+			options.Logger.Info("pruned", "file", candidate, "trash", target)
+			removed = append(removed, candidate)
+			continue
+		}
+		fmt.Fprintln(out, "Removing", candidate)
+		if removeError := os.RemoveAll(candidate); removeError != nil {
+			fmt.Fprintln(out, removeError)
+			options.Logger.Warn("pruning failed", "file", candidate, "error", removeError)
+			continue
+		}
+		options.Logger.Info("pruned", "file", candidate)
+		removed = append(removed, candidate)
+	}
+	return removed
+}
+
+// protectedFiles returns the absolute paths of the files pruning must not
+// remove whatever the manifest says, most importantly the updater itself
+func protectedFiles(options UpdateOptions) []string {
+	names := []string{options.CacheFile, options.LockFile, options.StateFile}
+	if executable, err := os.Executable(); err == nil {
+		names = append(names, executable)
+		if resolved, err := filepath.EvalSymlinks(executable); err == nil {
+			names = append(names, resolved)
+		}
+	}
+	var protected []string
+	for _, name := range names {
+		if absolutePath, err := filepath.Abs(name); err == nil {
+			protected = append(protected, absolutePath)
+		}
+	}
+	return protected
+}
+
+func isProtected(candidate string, protected []string, patterns []string) bool {
+	if absolutePath, err := filepath.Abs(filepath.FromSlash(candidate)); err == nil {
+		if stringInSlice(absolutePath, protected) || path.Base(candidate) == ManifestFileName {
+			return true
+		}
+	}
+	// the trash and the backups are there to get pruned files back
+	for _, keptDir := range []string{TrashDirName, BackupDirName} {
+		if strings.HasPrefix(candidate, keptDir+"/") {
+			return true
+		}
+	}
+	return matchesAny(patterns, candidate)
+}
+
+// findUnlistedFiles walks directoriesToPrune and returns the slash separated
+// paths of all files that are not in the repository. Directories matching
+// options.PruneExclude are not entered at all. With managed patterns, see
+// Repository.Managed, the current directory is walked instead, skipping
+// the directories that can't hold a managed file.
+func findUnlistedFiles(directoriesToPrune []string, managed []string, listOfRepositoryFiles []File, options UpdateOptions) []string {
+	if len(managed) > 0 {
+		directoriesToPrune = []string{"."}
+	}
+	var unlisted []string
+	for _, pruneDir := range directoriesToPrune {
+		if _, err := os.Stat(pruneDir); os.IsNotExist(err) {
+			continue
+		}
+		filepath.Walk(pruneDir, func(currentPath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			currentPathSlash := filepath.ToSlash(currentPath)
+			if info.IsDir() {
+				if currentPathSlash == "." {
+					return nil
+				}
+				if len(managed) > 0 && !mayHoldManaged(managed, currentPathSlash) {
+					return filepath.SkipDir
+				}
+				if matchesAny(options.PruneExclude, currentPathSlash) {
+					fmt.Fprintln(options.Output, "Keeping", currentPathSlash+"/", ": excluded from pruning")
+					options.Logger.Info("directory excluded from pruning", "directory", currentPathSlash)
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if len(managed) > 0 && !isManaged(managed, currentPathSlash) {
+				return nil
+			}
+			for _, rf := range listOfRepositoryFiles {
+				if currentPathSlash == rf.Name {
+					return nil
+				}
+			}
+			unlisted = append(unlisted, currentPathSlash)
+			return nil
+		})
+	}
+	return unlisted
+}
+
+// isManaged reports whether name or one of its directories matches one of
+// the managed patterns, which unlike other MatchGlob patterns always start
+// from the top directory
+func isManaged(managed []string, name string) bool {
+	for _, pattern := range managed {
+		if MatchGlob("/"+strings.TrimPrefix(pattern, "/"), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayHoldManaged reports whether the directory dir either is managed or is
+// on the way to a directory that may be
+func mayHoldManaged(managed []string, dir string) bool {
+	segments := strings.Split(dir, "/")
+	for _, pattern := range managed {
+		patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+		leads := true
+		for i, segment := range segments {
+			if i >= len(patternSegments) || patternSegments[i] == "**" {
+				break
+			}
+			if matched, _ := path.Match(patternSegments[i], segment); !matched {
+				leads = false
+				break
+			}
+		}
+		if leads {
+			return true
+		}
+	}
+	return false
+}
+
+// pendingHash is the hash of a local file being worked out by hashFiles
+type pendingHash struct {
+	hash string
+	err  error
+	done chan struct{}
+}
+
+// hashFiles hashes the local copies of the files selected by needsHash with
+// concurrency workers, see cachedHash. The hash of files[i] can be read once
+// hashes[i].done is closed, so that the caller can go through the files in
+// order while the later ones are still being hashed. hashes[i] is nil for
+// the files that were not selected.
+func hashFiles(ctx context.Context, cache *hashCache, files []File, needsHash func(File) bool, concurrency int) []*pendingHash {
+	hashes := make([]*pendingHash, len(files))
+	var toHash []int
+	for i, rf := range files {
+		if needsHash(rf) {
+			hashes[i] = &pendingHash{done: make(chan struct{})}
+			toHash = append(toHash, i)
+		}
+	}
+	indexes := make(chan int)
+	for worker := 0; worker < concurrency; worker++ {
+		go func() {
+			for i := range indexes {
+				// the rest are skipped quickly once cancelled
+				if ctx.Err() != nil {
+					hashes[i].err = ctx.Err()
+				} else {
+					hashes[i].hash, hashes[i].err = cachedHash(cache, files[i])
+				}
+				close(hashes[i].done)
+			}
+		}()
+	}
+	go func() {
+		for _, i := range toHash {
+			indexes <- i
+		}
+		close(indexes)
+	}()
+	return hashes
+}
+
+// verifyInstall reads every file in scope again, without trusting the hash
+// cache, and returns the ones that don't match the repository. It catches
+// downloads that went wrong without an error and files pruned by mistake.
+// The hashes replace the ones in cache, so that the next run downloads the
+// files that don't match.
+func verifyInstall(ctx context.Context, cache *hashCache, files []File, options UpdateOptions) []FileError {
+	out := options.Output
+	fmt.Fprintln(out, "")
+	fmt.Fprintln(out, "Verifying the installed files")
+	inScope := func(rf File) bool {
+		return rf.HasValidPath() && options.inScope(rf.Name)
+	}
+	uncached := &hashCache{Entries: make(map[string]hashCacheEntry)}
+	hashes := hashFiles(ctx, uncached, files, func(rf File) bool {
+		return len(rf.Link) == 0 && inScope(rf)
+	}, options.Concurrency)
+	unverified := []FileError{}
+	checked := 0
+	for i, rf := range files {
+		if !inScope(rf) {
+			continue
+		}
+		checked++
+		var problem string
+		if len(rf.Link) > 0 {
+			if !linkMatches(rf) {
+				problem = "not a link to " + rf.Link
+			}
+		} else {
+			<-hashes[i].done
+			switch {
+			case os.IsNotExist(hashes[i].err):
+				problem = "missing"
+			case hashes[i].err != nil:
+				problem = hashes[i].err.Error()
+			case hashes[i].hash != rf.Hash:
+				problem = "checksum doesn't match"
+			}
+		}
+		if len(problem) > 0 {
+			fmt.Fprintln(out, rf.Name, ":", colored(options.Color, colorFailed, problem))
+			options.Logger.Warn("file doesn't match after the update", "file", rf.Name, "problem", problem)
+			unverified = append(unverified, FileError{rf.Name, problem})
+		}
+	}
+	if ctx.Err() == nil {
+		fmt.Fprintf(out, "%d of %d files match the repository\n", checked-len(unverified), checked)
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for name, entry := range uncached.Entries {
+		cache.Entries[name] = entry
+	}
+	return unverified
+}
+
+// cachedHash returns the hash of the local copy of rf, reading the file only
+// if the cache doesn't have an up to date hash for it
+func cachedHash(cache *hashCache, rf File) (string, error) {
+	info, statError := os.Stat(rf.Name)
+	if statError != nil {
+		return "", statError
+	}
+	if hash, found := cache.Lookup(rf.Name, info, rf.cacheAlgo()); found {
+		return hash, nil
+	}
+
+	existingFile, openError := os.Open(rf.Name)
+	if openError != nil {
+		return "", openError
+	}
+	defer existingFile.Close()
+
+	hash, hashError := rf.calculateHash(existingFile)
+	if hashError != nil {
+		return "", hashError
+	}
+	cache.Store(rf.Name, info, rf.cacheAlgo(), hash)
+	return hash, nil
+}
@@ -0,0 +1,27 @@
+package updater
+
+import "errors"
+
+// Verifier checks files beyond the hash in the manifest, such as against an
+// integrity database or signatures kept by the publisher. It is only asked
+// about files whose hash already matches, see UpdateOptions.Verifier.
+type Verifier interface {
+	// Verify reports whether the file at path is a good copy of entry. The
+	// path of a download is its temp file, before it replaces the old copy.
+	// An error means the file couldn't be checked at all
+	Verify(path string, entry File) (bool, error)
+}
+
+// errRejected is returned for a download the Verifier did not accept
+var errRejected = errors.New("rejected by the verifier")
+
+// verify asks options.Verifier about the file at path, accepting it when
+// there is no Verifier
+func (o *UpdateOptions) verify(path string, rf File) (bool, error) {
+	if o.Verifier == nil {
+		return true, nil
+	}
+	ok, err := o.Verifier.Verify(path, rf)
+	o.Logger.Debug("verified", "file", rf.Name, "path", path, "ok", ok, "error", err)
+	return ok, err
+}
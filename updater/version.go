@@ -0,0 +1,60 @@
+package updater
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Version of the updater, sent in the User-Agent and compared against the
+// MinUpdaterVersion of manifests. Releases set it with
+// -ldflags "-X github.com/tuomur/polloeskadroona_updater/updater.Version=..."
+var Version = "1.0.0"
+
+// DefaultUpdaterURL is where to get a new updater when the manifest doesn't
+// say
+const DefaultUpdaterURL = "https://github.com/tuomur/polloeskadroona_updater/releases"
+
+// DefaultUserAgent is used when UpdateOptions.UserAgent is not set
+func DefaultUserAgent() string {
+	return "polloeskadroona-updater/" + Version
+}
+
+// parseVersion reads a version such as "1.2.3" or "v1.2.3-rc1" into its
+// numbers. ok is false for versions like "dev" that have no numbers.
+func parseVersion(version string) (numbers []int, ok bool) {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	if end := strings.IndexAny(version, "-+ "); end >= 0 {
+		version = version[:end]
+	}
+	for _, part := range strings.Split(version, ".") {
+		number, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers, true
+}
+
+// versionBelow reports whether version is older than minimum. A version
+// that can't be parsed is a development build and never too old.
+func versionBelow(version string, minimum string) bool {
+	current, currentOk := parseVersion(version)
+	required, requiredOk := parseVersion(minimum)
+	if !currentOk || !requiredOk {
+		return false
+	}
+	for i := 0; i < len(current) || i < len(required); i++ {
+		var a, b int
+		if i < len(current) {
+			a = current[i]
+		}
+		if i < len(required) {
+			b = required[i]
+		}
+		if a != b {
+			return a < b
+		}
+	}
+	return false
+}